@@ -18,7 +18,9 @@ package v1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -32,12 +34,34 @@ type EtcdSpec struct {
 	Members      int    `json:"members,omitempty"`
 	ExternalHost string `json:"externalHost,omitempty"`
 
+	// Service how clients reach the cluster, defaults to a NodePort per member
+	Service *ServiceSpec `json:"service,omitempty"`
+
+	// NetworkPolicy restricts traffic to the members when set
+	NetworkPolicy *NetworkPolicySpec `json:"networkPolicy,omitempty"`
+
+	// TLS serves clients over https with certs issued by the operator, it can only be set on create
+	TLS *TLSSpec `json:"tls,omitempty"`
+
+	// Auth enables etcd authentication, the root password is kept in the <name>-auth Secret
+	Auth *AuthSpec `json:"auth,omitempty"`
+
+	// ConnectionSecret is the Secret published for applications, defaults to <name>-connection
+	ConnectionSecret string `json:"connectionSecret,omitempty"`
+
+	// KubeApiserverClient issues a client cert for a kube-apiserver using the cluster as external storage,
+	// it turns TLS on
+	KubeApiserverClient *KubeApiserverClientSpec `json:"kubeApiserverClient,omitempty"`
+
 	// quota 配额
 	Cpu              string `json:"cpu,omitempty"`
 	Memory           string `json:"memory,omitempty"`
 	Storage          string `json:"storage,omitempty"`
 	StorageClassName string `json:"storageClassName,omitempty"`
 
+	// WalStorage puts the write-ahead log on its own PVC
+	WalStorage *WalStorage `json:"walStorage,omitempty"`
+
 	Image            string                        `json:"image,omitempty"`
 	ImagePullPolicy  corev1.PullPolicy             `json:"imagePullPolicy,omitempty" protobuf:"bytes,14,opt,name=imagePullPolicy,casttype=PullPolicy"`
 	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty" patchStrategy:"merge" patchMergeKey:"name" protobuf:"bytes,15,rep,name=imagePullSecrets"`
@@ -47,6 +71,243 @@ type EtcdSpec struct {
 	Env []corev1.EnvVar `json:"env,omitempty"`
 
 	PodSpec PodSpec `json:"podSpec,omitempty"`
+
+	// Monitoring creates a ServiceMonitor or PodMonitor when the prometheus-operator CRDs are installed
+	Monitoring *MonitoringSpec `json:"monitoring,omitempty"`
+
+	// Probes timings of the etcd container probes, unset fields keep their defaults
+	Probes *ProbesSpec `json:"probes,omitempty"`
+
+	// Metadata labels and annotations added to the generated objects, operator labels can not be overwritten
+	Metadata *ResourceMetadata `json:"metadata,omitempty"`
+
+	// Overrides are strategic-merge-patched over the generated objects, fields owned by the operator are kept
+	Overrides *Overrides `json:"overrides,omitempty"`
+
+	// Placement spreads members across nodes and zones, ignored when podSpec.affinity is set
+	Placement *Placement `json:"placement,omitempty"`
+
+	// Upgrade controls how a change of Image is rolled out
+	Upgrade *UpgradeSpec `json:"upgrade,omitempty"`
+
+	// DeletionPolicy what happens to the member PVCs when the Etcd is deleted
+	// +kubebuilder:validation:Enum=Delete;Retain;Snapshot
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// DeletionSnapshot is where the final snapshot is written, required by the Snapshot policy
+	DeletionSnapshot *SnapshotDestination `json:"deletionSnapshot,omitempty"`
+
+	// AdoptVolumes starts the members from the PVCs retained by an earlier cluster of the same name
+	AdoptVolumes bool `json:"adoptVolumes,omitempty"`
+
+	// DeletionProtection rejects deletes of the Etcd, its StatefulSet and PVCs until cleared.
+	// The etcd-operator/deletion-protection: "true" annotation has the same effect.
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+}
+
+type ServiceSpec struct {
+	// +kubebuilder:validation:Enum=None;ClusterIP;NodePort;LoadBalancer;SharedLoadBalancer
+	Type ServiceExposure `json:"type,omitempty"`
+
+	// Annotations added to the client Services, e.g. to configure the cloud load balancer
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type NetworkPolicySpec struct {
+	// AllowedClients may reach the client port, besides the members, their jobs and the operator.
+	// Clients coming through a NodePort or LoadBalancer need an ipBlock.
+	AllowedClients []networkingv1.NetworkPolicyPeer `json:"allowedClients,omitempty"`
+
+	// AllowedScrapers may reach the metrics port, e.g. the Prometheus pods
+	AllowedScrapers []networkingv1.NetworkPolicyPeer `json:"allowedScrapers,omitempty"`
+}
+
+type MonitoringSpec struct {
+	// Kind of the monitor, defaults to ServiceMonitor
+	// +kubebuilder:validation:Enum=ServiceMonitor;PodMonitor
+	Kind MonitorKind `json:"kind,omitempty"`
+
+	// Labels of the monitor, to be picked by the serviceMonitorSelector or podMonitorSelector of the Prometheus
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ScrapeLabels added to every series scraped from the members
+	ScrapeLabels map[string]string `json:"scrapeLabels,omitempty"`
+
+	// Interval between scrapes, the Prometheus default when empty
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	Interval string `json:"interval,omitempty"`
+
+	// TLS serves metrics over https with the client cert auth of the cluster and scrapes them with the client cert,
+	// requires spec.tls. The plain http port is kept for the probes.
+	TLS bool `json:"tls,omitempty"`
+
+	// Alerts creates a PrometheusRule with the standard etcd alerts when the CRD is installed
+	Alerts *AlertsSpec `json:"alerts,omitempty"`
+}
+
+// AlertsSpec thresholds left unset keep their defaults
+type AlertsSpec struct {
+	// LeaderChangesPerHour fires when a member sees more leader changes in the last hour, defaults to 4
+	// +kubebuilder:validation:Minimum=1
+	LeaderChangesPerHour int32 `json:"leaderChangesPerHour,omitempty"`
+
+	// FsyncLatencyMilliseconds fires when the p99 of WAL fsync is above, defaults to 500
+	// +kubebuilder:validation:Minimum=1
+	FsyncLatencyMilliseconds int32 `json:"fsyncLatencyMilliseconds,omitempty"`
+
+	// CommitLatencyMilliseconds fires when the p99 of backend commit is above, defaults to 250
+	// +kubebuilder:validation:Minimum=1
+	CommitLatencyMilliseconds int32 `json:"commitLatencyMilliseconds,omitempty"`
+
+	// DBSizePercent fires when the db uses more of the backend quota, defaults to 80
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	DBSizePercent int32 `json:"dbSizePercent,omitempty"`
+
+	// FailedProposalsPerHour fires when a member fails more proposals in the last hour, defaults to 5
+	// +kubebuilder:validation:Minimum=1
+	FailedProposalsPerHour int32 `json:"failedProposalsPerHour,omitempty"`
+}
+
+type MonitorKind string
+
+const (
+	ServiceMonitor MonitorKind = "ServiceMonitor"
+	PodMonitor     MonitorKind = "PodMonitor"
+)
+
+type ProbesSpec struct {
+	Readiness *ProbeTiming `json:"readiness,omitempty"`
+	Liveness  *ProbeTiming `json:"liveness,omitempty"`
+
+	// Startup holds off liveness until the member serves, raise failureThreshold for large databases
+	Startup *ProbeTiming `json:"startup,omitempty"`
+}
+
+type ProbeTiming struct {
+	// +kubebuilder:validation:Minimum=0
+	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	PeriodSeconds int32 `json:"periodSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+}
+
+type ResourceMetadata struct {
+	// Labels and Annotations apply to every generated object
+	ObjectMetadata `json:",inline"`
+
+	// Pods of the members and jobs, added to the pod templates
+	Pods *ObjectMetadata `json:"pods,omitempty"`
+
+	Services *ObjectMetadata `json:"services,omitempty"`
+
+	// PersistentVolumeClaims of the members and snapshots
+	PersistentVolumeClaims *ObjectMetadata `json:"persistentVolumeClaims,omitempty"`
+
+	StatefulSet *ObjectMetadata `json:"statefulSet,omitempty"`
+}
+
+// ObjectMetadata per-kind values win over the common ones
+type ObjectMetadata struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Overrides struct {
+	// StatefulSet partial StatefulSet, e.g. spec.template.spec.priorityClassName or a sidecar.
+	// name, selector, replicas, serviceName, updateStrategy, volumeClaimTemplates,
+	// selector labels and the image and command of the etcd container are kept.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	StatefulSet *runtime.RawExtension `json:"statefulSet,omitempty"`
+
+	// Services partial Service applied to every Service of the cluster,
+	// name, selector, type and clusterIP are kept.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Services *runtime.RawExtension `json:"services,omitempty"`
+}
+
+type Placement struct {
+	// Mode Preferred lets members share a topology domain when there is no room elsewhere, Required never does
+	// +kubebuilder:validation:Enum=Preferred;Required
+	Mode PlacementMode `json:"mode,omitempty"`
+
+	// TopologyKeys members are kept apart on, defaults to kubernetes.io/hostname
+	TopologyKeys []string `json:"topologyKeys,omitempty"`
+
+	// TopologySpreadConstraints are passed to the members, an empty labelSelector selects the members
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+}
+
+type PlacementMode string
+
+const (
+	PlacementPreferred PlacementMode = "Preferred"
+	PlacementRequired  PlacementMode = "Required"
+)
+
+const (
+	TopologyKeyHostname = "kubernetes.io/hostname"
+	TopologyKeyZone     = "topology.kubernetes.io/zone"
+)
+
+type TLSSpec struct {
+	// Enabled serves clients over https and requires a client cert signed by the cluster CA
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+type AuthSpec struct {
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+type KubeApiserverClientSpec struct {
+	// SecretName defaults to <name>-apiserver-etcd-client
+	SecretName string `json:"secretName,omitempty"`
+
+	// CommonName of the client cert, defaults to kube-apiserver-etcd-client as issued by kubeadm
+	CommonName string `json:"commonName,omitempty"`
+}
+
+type WalStorage struct {
+	Size string `json:"size"`
+
+	// StorageClassName defaults to spec.storageClassName
+	StorageClassName string `json:"storageClassName,omitempty"`
+}
+
+type UpgradeSpec struct {
+	// MemberTimeoutSeconds is how long an upgraded member may take to rejoin
+	// before the rollout is paused and the image reverted
+	MemberTimeoutSeconds int32 `json:"memberTimeoutSeconds,omitempty"`
+
+	// Snapshot is where the pre-upgrade snapshot is written,
+	// defaults to a PVC managed by the operator
+	Snapshot *SnapshotDestination `json:"snapshot,omitempty"`
+}
+
+// SnapshotDestination exactly one of the fields must be set
+type SnapshotDestination struct {
+	PVC *PVCDestination `json:"pvc,omitempty"`
+	S3  *S3Destination  `json:"s3,omitempty"`
+}
+
+type PVCDestination struct {
+	ClaimName string `json:"claimName"`
+}
+
+type S3Destination struct {
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Region   string `json:"region,omitempty"`
+
+	// CredentialsSecret holds AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+
+	// Image runs the upload, it must provide the aws cli
+	Image string `json:"image,omitempty"`
 }
 
 // EtcdStatus defines the observed state of Etcd
@@ -57,12 +318,76 @@ type EtcdStatus struct {
 	Status      NodeStatus         `json:"status"`
 	ConnectAddr string             `json:"connectAddr,omitempty"`
 	Conditions  []metav1.Condition `json:"conditions,omitempty"`
+
+	// Image is the image all members are running
+	Image   string         `json:"image,omitempty"`
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+
+	Adoption *AdoptionStatus `json:"adoption,omitempty"`
+
+	// AuthEnabled whether authentication has been enabled on the cluster
+	AuthEnabled bool `json:"authEnabled,omitempty"`
+
+	// Members where each member is scheduled
+	Members []MemberStatus `json:"members,omitempty"`
+
+	// KubeApiserverUser the etcd user granted to the kube-apiserver client cert CN while auth is enabled
+	KubeApiserverUser string `json:"kubeApiserverUser,omitempty"`
+
+	// AppUser the etcd user of the connection Secret, created once auth is enabled
+	AppUser string `json:"appUser,omitempty"`
+
+	// LastSnapshotTime completion of the last successful snapshot job, kept after the job is removed
+	LastSnapshotTime *metav1.Time `json:"lastSnapshotTime,omitempty"`
+
+	// Monitor kind of the monitor created for spec.monitoring, removed when the kind changes
+	Monitor MonitorKind `json:"monitor,omitempty"`
+
+	// PrometheusRule whether the alerts of spec.monitoring.alerts have been created
+	PrometheusRule bool `json:"prometheusRule,omitempty"`
+}
+
+type MemberStatus struct {
+	Name string `json:"name"`
+	Node string `json:"node,omitempty"`
+	Zone string `json:"zone,omitempty"`
+}
+
+type AdoptionStatus struct {
+	Phase AdoptionPhase `json:"phase"`
+
+	// PreviousUID uid of the cluster the PVCs were retained from
+	PreviousUID string `json:"previousUID,omitempty"`
+	// ClusterID read from the data, hex encoded
+	ClusterID string `json:"clusterID,omitempty"`
+
+	Reason string `json:"reason,omitempty"`
+}
+
+type UpgradeStatus struct {
+	Phase     UpgradePhase `json:"phase"`
+	FromImage string       `json:"fromImage"`
+	ToImage   string       `json:"toImage"`
+
+	// Partition members with an ordinal >= Partition run ToImage
+	Partition int32 `json:"partition"`
+
+	// StartTime tells a retried upgrade between the same images from the earlier attempt
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CurrentMember is the ordinal of the member being upgraded
+	CurrentMember   *int32       `json:"currentMember,omitempty"`
+	MemberStartTime *metav1.Time `json:"memberStartTime,omitempty"`
+
+	Reason string `json:"reason,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="status",type=string,JSONPath=`.status.status`
 // +kubebuilder:printcolumn:name="connectAddr",type=string,JSONPath=`.status.connectAddr`
+// +kubebuilder:printcolumn:name="upgrade",type=string,JSONPath=`.status.upgrade.phase`
+// +kubebuilder:printcolumn:name="upgradingMember",type=integer,JSONPath=`.status.upgrade.currentMember`
 
 // Etcd is the Schema for the etcds API
 type Etcd struct {
@@ -86,6 +411,115 @@ func init() {
 	SchemeBuilder.Register(&Etcd{}, &EtcdList{})
 }
 
+const (
+	AnnotationDeletionProtection = "etcd-operator/deletion-protection"
+	// AnnotationSkipFinalSnapshot lets a cluster with the Snapshot policy be deleted after its final snapshot failed
+	AnnotationSkipFinalSnapshot = "etcd-operator/skip-final-snapshot"
+
+	// KubeApiserverClientCN is the CN kubeadm gives the apiserver-etcd-client cert
+	KubeApiserverClientCN = "kube-apiserver-etcd-client"
+)
+
+// DeletionProtected reports whether deletes of the cluster must be rejected
+func (in *Etcd) DeletionProtected() bool {
+	return in.Spec.DeletionProtection || in.Annotations[AnnotationDeletionProtection] == "true"
+}
+
+// ZonesNeeded the zones the members must span so that losing one keeps the quorum,
+// 0 when they are not spread by zone or the cluster can not lose a member anyway
+func (in *Etcd) ZonesNeeded() int {
+	if in.Spec.Placement == nil {
+		return 0
+	}
+
+	spread := false
+	for _, key := range in.Spec.Placement.TopologyKeys {
+		spread = spread || key == TopologyKeyZone
+	}
+
+	tolerated := in.Spec.Members - (in.Spec.Members/2 + 1)
+	if !spread || tolerated < 1 {
+		return 0
+	}
+
+	// no zone may hold more members than the cluster can lose
+	return (in.Spec.Members + tolerated - 1) / tolerated
+}
+
+func (in *Etcd) TLSEnabled() bool {
+	return in.Spec.TLS != nil && in.Spec.TLS.Enabled
+}
+
+func (in *Etcd) AuthEnabled() bool {
+	return in.Spec.Auth != nil && in.Spec.Auth.Enabled
+}
+
+// MetricsTLS whether the members serve metrics over https
+func (in *Etcd) MetricsTLS() bool {
+	return in.Spec.Monitoring != nil && in.Spec.Monitoring.TLS && in.TLSEnabled()
+}
+
+// CASecretName holds the cluster CA, only the operator reads it
+func (in *Etcd) CASecretName() string {
+	return in.Name + "-ca"
+}
+
+// ServerTLSSecretName holds the serving cert mounted by the members
+func (in *Etcd) ServerTLSSecretName() string {
+	return in.Name + "-server-tls"
+}
+
+// ClientTLSSecretName holds the client cert used by the operator and its jobs
+func (in *Etcd) ClientTLSSecretName() string {
+	return in.Name + "-client-tls"
+}
+
+// AppTLSSecretName holds the client cert published to applications, its CN is the app user
+func (in *Etcd) AppTLSSecretName() string {
+	return in.Name + "-app-tls"
+}
+
+// ConnectionSecretName holds the endpoints and credentials published for applications
+func (in *Etcd) ConnectionSecretName() string {
+	if in.Spec.ConnectionSecret != "" {
+		return in.Spec.ConnectionSecret
+	}
+
+	return in.Name + "-connection"
+}
+
+// KubeApiserverClientSecretName holds the kube-apiserver client cert in the layout kubeadm expects
+func (in *Etcd) KubeApiserverClientSecretName() string {
+	if c := in.Spec.KubeApiserverClient; c != nil && c.SecretName != "" {
+		return c.SecretName
+	}
+
+	return in.Name + "-apiserver-etcd-client"
+}
+
+// AuthSecretName holds the root username and password
+func (in *Etcd) AuthSecretName() string {
+	return in.Name + "-auth"
+}
+
+// AppAuthSecretName holds the username and password published to applications
+func (in *Etcd) AppAuthSecretName() string {
+	return in.Name + "-app-auth"
+}
+
+// managedSecretNames Secrets the operator writes besides the connection Secret
+func (in *Etcd) managedSecretNames() []string {
+	r := []string{
+		in.CASecretName(), in.ServerTLSSecretName(), in.ClientTLSSecretName(), in.AppTLSSecretName(),
+		in.AuthSecretName(), in.AppAuthSecretName(),
+	}
+	if in.Spec.KubeApiserverClient != nil {
+		r = append(r, in.KubeApiserverClientSecretName())
+	}
+
+	return r
+}
+
 // copy from corev1.PodSpec
 type PodSpec struct {
 	HostAliases     []corev1.HostAlias         `json:"hostAliases,omitempty" patchStrategy:"merge" patchMergeKey:"ip" protobuf:"bytes,23,rep,name=hostAliases"`
@@ -104,3 +538,67 @@ const (
 	StatusFailed       NodeStatus = "Failed"
 	StatusUnknown      NodeStatus = "Unknown"
 )
+
+const (
+	// ConditionDegraded is true while the spec can not be reconciled, until it is changed
+	ConditionDegraded = "Degraded"
+
+	ReasonInvalidSpec = "InvalidSpec"
+	ReasonReconciled  = "Reconciled"
+
+	// ConditionZoneSpread is false while the members span fewer zones than they need to survive
+	// a zone outage, only set when the members are spread by zone
+	ConditionZoneSpread = "ZoneSpread"
+
+	ReasonEnoughZones       = "EnoughZones"
+	ReasonInsufficientZones = "InsufficientZones"
+
+	// ConditionFinalSnapshotBlocked is true while the final snapshot can not be taken because the members are gone
+	ConditionFinalSnapshotBlocked = "FinalSnapshotBlocked"
+
+	ReasonMembersRemoved = "MembersRemoved"
+)
+
+type UpgradePhase string
+
+const (
+	UpgradePhaseSnapshot  UpgradePhase = "Snapshot"
+	UpgradePhaseUpgrading UpgradePhase = "Upgrading"
+	UpgradePhasePaused    UpgradePhase = "Paused"
+)
+
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the PVCs
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain keeps the PVCs and labels them as orphaned
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicySnapshot writes a final snapshot, then deletes the member PVCs.
+	// The snapshot is read from the running members, a foreground cascading delete removes them
+	// first and blocks the deletion with the FinalSnapshotBlocked condition, delete in the background
+	DeletionPolicySnapshot DeletionPolicy = "Snapshot"
+)
+
+type AdoptionPhase string
+
+const (
+	AdoptionPhaseInspecting AdoptionPhase = "Inspecting"
+	AdoptionPhaseAdopted    AdoptionPhase = "Adopted"
+	AdoptionPhaseFailed     AdoptionPhase = "Failed"
+)
+
+type ServiceExposure string
+
+const (
+	// ServiceExposureNone only the headless Service, reachable in-cluster
+	ServiceExposureNone ServiceExposure = "None"
+	// ServiceExposureClusterIP one ClusterIP Service shared by all members
+	ServiceExposureClusterIP ServiceExposure = "ClusterIP"
+	// ServiceExposureNodePort one NodePort Service per member
+	ServiceExposureNodePort ServiceExposure = "NodePort"
+	// ServiceExposureLoadBalancer one LoadBalancer Service per member
+	ServiceExposureLoadBalancer ServiceExposure = "LoadBalancer"
+	// ServiceExposureSharedLoadBalancer one LoadBalancer Service shared by all members
+	ServiceExposureSharedLoadBalancer ServiceExposure = "SharedLoadBalancer"
+)
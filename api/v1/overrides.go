@@ -0,0 +1,76 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// MergeOverride strategic-merge-patches override over obj, a pointer to a typed object
+func MergeOverride(obj interface{}, override *runtime.RawExtension) error {
+	if override == nil || len(override.Raw) == 0 {
+		return nil
+	}
+
+	err := rejectDirectives(override.Raw)
+	if err != nil {
+		return err
+	}
+
+	original, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	merged, err := strategicpatch.StrategicMergePatch(original, override.Raw, obj)
+	if err != nil {
+		return err
+	}
+
+	// unmarshal into a zero value, fields removed by the patch must not survive
+	v := reflect.ValueOf(obj).Elem()
+	v.Set(reflect.Zero(v.Type()))
+
+	return json.Unmarshal(merged, obj)
+}
+
+// rejectDirectives overrides add and change fields, $patch, $setElementOrder and the like could drop
+// containers, volumes or ports the operator relies on
+func rejectDirectives(raw []byte) error {
+	var v interface{}
+	err := json.Unmarshal(raw, &v)
+	if err != nil {
+		return err
+	}
+
+	return walkDirectives(v, "")
+}
+
+func walkDirectives(v interface{}, path string) error {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range t {
+			if strings.HasPrefix(k, "$") {
+				return fmt.Errorf("patch directive %s%s is not supported", path, k)
+			}
+
+			err := walkDirectives(sub, path+k+".")
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, sub := range t {
+			err := walkDirectives(sub, fmt.Sprintf("%s%d.", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
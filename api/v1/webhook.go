@@ -1,13 +1,23 @@
 package v1
 
 import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
 	log "github.com/win5do/go-lib/logx"
 	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -16,6 +26,14 @@ import (
 	"github.com/win5do/etcd-operator/pkg/conf"
 )
 
+const (
+	annotationDefaultStorageClass     = "storageclass.kubernetes.io/is-default-class"
+	annotationBetaDefaultStorageClass = "storageclass.beta.kubernetes.io/is-default-class"
+)
+
+// whReader reads the cluster objects a validation depends on, nil when not running in the manager
+var whReader client.Reader
+
 func whLog() *zap.SugaredLogger {
 	return log.With("webhook", "Etcd")
 }
@@ -23,6 +41,8 @@ func whLog() *zap.SugaredLogger {
 func (in *Etcd) SetupWebhookWithManager(mgr ctrl.Manager) error {
 	whLog().Info("setup webhook")
 
+	whReader = mgr.GetAPIReader()
+
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(in).
 		Complete()
@@ -52,10 +72,44 @@ func (in *Etcd) Default() {
 		in.Spec.ExternalHost = cfg.EXTERNAL_DOMAIN
 	}
 
+	if in.Spec.Service == nil {
+		in.Spec.Service = &ServiceSpec{}
+	}
+
+	if in.Spec.Service.Type == "" {
+		in.Spec.Service.Type = ServiceExposureNodePort
+	}
+
 	if in.Spec.StorageClassName == "" {
 		in.Spec.StorageClassName = cfg.STORAGE_CLASS_NAME
 	}
 
+	if in.Spec.KubeApiserverClient != nil {
+		if in.Spec.KubeApiserverClient.CommonName == "" {
+			in.Spec.KubeApiserverClient.CommonName = KubeApiserverClientCN
+		}
+
+		if in.Spec.TLS == nil {
+			in.Spec.TLS = &TLSSpec{Enabled: true}
+		}
+	}
+
+	if in.Spec.Monitoring != nil && in.Spec.Monitoring.Kind == "" {
+		in.Spec.Monitoring.Kind = ServiceMonitor
+	}
+
+	if in.Spec.ConnectionSecret == "" {
+		in.Spec.ConnectionSecret = in.ConnectionSecretName()
+	}
+
+	if in.Spec.DeletionPolicy == "" {
+		in.Spec.DeletionPolicy = DeletionPolicyDelete
+	}
+
+	if in.Spec.WalStorage != nil && in.Spec.WalStorage.StorageClassName == "" {
+		in.Spec.WalStorage.StorageClassName = in.Spec.StorageClassName
+	}
+
 	specEnv = MergeEnv(specEnv, cfg.InstanceEnv)
 }
 
@@ -74,19 +128,46 @@ func (in *Etcd) ValidateUpdate(old runtime.Object) error {
 
 	oldCr := old.(*Etcd)
 
+	if in.Spec.KubeApiserverClient != nil && !oldCr.TLSEnabled() {
+		// Default turned TLS on along with the client, report the cause instead of the immutable tls
+		return apierrors.NewInvalid(
+			schema.GroupKind{Group: "db.gogo.io", Kind: "Etcd"},
+			in.Name, field.ErrorList{field.Forbidden(field.NewPath("spec").Child("kubeApiserverClient"),
+				"client TLS requires server TLS, which can only be enabled at creation")})
+	}
+
 	arrErrs := validation.ValidateImmutableField(in.Spec.Members, oldCr.Spec.Members, field.NewPath("spec").Child("nodeNumber"))
+	// members would have to be restarted with a different scheme at once
+	arrErrs = append(arrErrs, validation.ValidateImmutableField(in.TLSEnabled(), oldCr.TLSEnabled(), field.NewPath("spec").Child("tls", "enabled"))...)
 
 	if len(arrErrs) > 0 {
 		return arrErrs[0]
 	}
 
-	return in.validateCr()
+	err := in.validateCr()
+	if err != nil {
+		return err
+	}
+
+	if fieldErr := in.validateStorageUpdate(oldCr); fieldErr != nil {
+		return apierrors.NewInvalid(
+			schema.GroupKind{Group: "db.gogo.io", Kind: "Etcd"},
+			in.Name, field.ErrorList{fieldErr})
+	}
+
+	return nil
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (in *Etcd) ValidateDelete() error {
 	whLog().Info("validate delete", "name", in.Name)
 
+	if in.DeletionProtected() {
+		return apierrors.NewForbidden(
+			schema.GroupResource{Group: "db.gogo.io", Resource: "etcds"},
+			in.Name, fmt.Errorf("deletion protection is enabled, clear spec.deletionProtection and the %s annotation first", AnnotationDeletionProtection))
+	}
+
 	return nil
 }
 
@@ -123,6 +204,274 @@ func (in *Etcd) validateSpec() *field.Error {
 		return err
 	}
 
+	if in.Spec.WalStorage != nil {
+		fldPath := field.NewPath("spec").Child("walStorage", "size")
+		if in.Spec.WalStorage.Size == "" {
+			return field.Required(fldPath, "")
+		}
+
+		err = validateResource(in.Spec.WalStorage.Size, fldPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if in.Spec.Upgrade != nil {
+		fldPath := field.NewPath("spec").Child("upgrade")
+		if in.Spec.Upgrade.MemberTimeoutSeconds < 0 {
+			return field.Invalid(fldPath.Child("memberTimeoutSeconds"), in.Spec.Upgrade.MemberTimeoutSeconds, "must not be negative")
+		}
+
+		err = validateSnapshotDestination(in.Spec.Upgrade.Snapshot, fldPath.Child("snapshot"))
+		if err != nil {
+			return err
+		}
+	}
+
+	if in.Spec.DeletionPolicy == DeletionPolicySnapshot {
+		fldPath := field.NewPath("spec").Child("deletionSnapshot")
+		if in.Spec.DeletionSnapshot == nil {
+			return field.Required(fldPath, "required by the Snapshot deletion policy")
+		}
+
+		err = validateSnapshotDestination(in.Spec.DeletionSnapshot, fldPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p := in.Spec.Placement; p != nil {
+		fldPath := field.NewPath("spec").Child("placement", "topologyKeys")
+		for i, key := range p.TopologyKeys {
+			if key != TopologyKeyHostname && key != TopologyKeyZone {
+				return field.NotSupported(fldPath.Index(i), key, []string{TopologyKeyHostname, TopologyKeyZone})
+			}
+		}
+	}
+
+	if m := in.Spec.Metadata; m != nil {
+		fldPath := field.NewPath("spec").Child("metadata")
+		if err := validateObjectMetadata(&m.ObjectMetadata, fldPath); err != nil {
+			return err
+		}
+		kinds := []struct {
+			name string
+			o    *ObjectMetadata
+		}{
+			{"pods", m.Pods},
+			{"services", m.Services},
+			{"persistentVolumeClaims", m.PersistentVolumeClaims},
+			{"statefulSet", m.StatefulSet},
+		}
+		for _, v := range kinds {
+			if err := validateObjectMetadata(v.o, fldPath.Child(v.name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if o := in.Spec.Overrides; o != nil {
+		fldPath := field.NewPath("spec").Child("overrides")
+		if err := MergeOverride(&appsv1.StatefulSet{}, o.StatefulSet); err != nil {
+			return field.Invalid(fldPath.Child("statefulSet"), string(o.StatefulSet.Raw), err.Error())
+		}
+		if err := MergeOverride(&corev1.Service{}, o.Services); err != nil {
+			return field.Invalid(fldPath.Child("services"), string(o.Services.Raw), err.Error())
+		}
+	}
+
+	if m := in.Spec.Monitoring; m != nil {
+		fldPath := field.NewPath("spec").Child("monitoring")
+		if m.TLS && !in.TLSEnabled() {
+			return field.Invalid(field.NewPath("spec").Child("tls", "enabled"), false, "required by spec.monitoring.tls")
+		}
+		for k := range m.ScrapeLabels {
+			if !promLabelRe.MatchString(k) {
+				return field.Invalid(fldPath.Child("scrapeLabels").Key(k), k, "must match "+promLabelRe.String())
+			}
+		}
+	}
+
+	if name := in.Spec.ConnectionSecret; name != "" {
+		for _, v := range in.managedSecretNames() {
+			if name == v {
+				return field.Invalid(field.NewPath("spec").Child("connectionSecret"), name, "collides with a Secret managed by the operator")
+			}
+		}
+	}
+
+	if in.Spec.KubeApiserverClient != nil && !in.TLSEnabled() {
+		return field.Invalid(field.NewPath("spec").Child("tls", "enabled"), false, "required by spec.kubeApiserverClient")
+	}
+
+	return nil
+}
+
+// validateStorageUpdate PVCs can only grow, and only on a storage class that allows expansion
+func (in *Etcd) validateStorageUpdate(old *Etcd) *field.Error {
+	fldPath := field.NewPath("spec").Child("storage")
+	if (in.Spec.Storage == "") != (old.Spec.Storage == "") {
+		return field.Forbidden(fldPath, "can not switch between emptyDir and PVC")
+	}
+
+	err := validateClaimResize(fldPath, old.Spec.Storage, in.Spec.Storage, in.Spec.StorageClassName)
+	if err != nil {
+		return err
+	}
+
+	walPath := field.NewPath("spec").Child("walStorage")
+	if (in.Spec.WalStorage == nil) != (old.Spec.WalStorage == nil) {
+		return field.Forbidden(walPath, "can not be added or removed after creation")
+	}
+
+	if in.Spec.WalStorage == nil {
+		return nil
+	}
+
+	if in.Spec.WalStorage.StorageClassName != old.Spec.WalStorage.StorageClassName {
+		return field.Forbidden(walPath.Child("storageClassName"), "field is immutable")
+	}
+
+	return validateClaimResize(walPath.Child("size"), old.Spec.WalStorage.Size, in.Spec.WalStorage.Size, in.Spec.WalStorage.StorageClassName)
+}
+
+func validateClaimResize(fldPath *field.Path, oldSize, newSize, storageClassName string) *field.Error {
+	if oldSize == newSize || oldSize == "" {
+		return nil
+	}
+
+	newQuantity, err := resource.ParseQuantity(newSize)
+	if err != nil {
+		return field.Invalid(fldPath, newSize, err.Error())
+	}
+
+	oldQuantity, err := resource.ParseQuantity(oldSize)
+	if err != nil {
+		return field.Invalid(fldPath, oldSize, fmt.Sprintf("current size is invalid: %s", err))
+	}
+
+	switch newQuantity.Cmp(oldQuantity) {
+	case 0:
+		return nil
+	case -1:
+		return field.Forbidden(fldPath, fmt.Sprintf("can not shrink from %s to %s", oldSize, newSize))
+	}
+
+	if whReader == nil {
+		return nil
+	}
+
+	sc, err := lookupStorageClass(whReader, storageClassName)
+	if err != nil {
+		return field.InternalError(fldPath, err)
+	}
+
+	if sc == nil {
+		return field.Forbidden(fldPath, "no storage class found, can not expand")
+	}
+
+	if sc.AllowVolumeExpansion == nil || !*sc.AllowVolumeExpansion {
+		return field.Forbidden(fldPath, fmt.Sprintf("storage class %s does not allow volume expansion", sc.Name))
+	}
+
+	return nil
+}
+
+// lookupStorageClass returns the named storage class, or the default one if name is empty
+func lookupStorageClass(reader client.Reader, name string) (*storagev1.StorageClass, error) {
+	ctx := context.Background()
+
+	if name != "" {
+		sc := &storagev1.StorageClass{}
+		err := reader.Get(ctx, client.ObjectKey{Name: name}, sc)
+		if err != nil {
+			return nil, err
+		}
+		return sc, nil
+	}
+
+	list := &storagev1.StorageClassList{}
+	err := reader.List(ctx, list)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range list.Items {
+		sc := &list.Items[i]
+		if sc.Annotations[annotationDefaultStorageClass] == "true" || sc.Annotations[annotationBetaDefaultStorageClass] == "true" {
+			return sc, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Ref: https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+var promLabelRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are set or selected on by the operator, see pkg/controller/label.go
+var reservedLabels = []string{
+	"cr-name", "cr-uid", "role", "component", "svc", "seq-id",
+	"app.kubernetes.io/name", "app.kubernetes.io/instance", "app.kubernetes.io/component", "app.kubernetes.io/managed-by",
+}
+
+const reservedPrefix = "etcd-operator/"
+
+func isReservedLabel(key string) bool {
+	for _, v := range reservedLabels {
+		if v == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateObjectMetadata(o *ObjectMetadata, fldPath *field.Path) *field.Error {
+	if o == nil {
+		return nil
+	}
+
+	errs := metav1validation.ValidateLabels(o.Labels, fldPath.Child("labels"))
+	errs = append(errs, validation.ValidateAnnotations(o.Annotations, fldPath.Child("annotations"))...)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	for k := range o.Labels {
+		if strings.HasPrefix(k, reservedPrefix) || isReservedLabel(k) {
+			return field.Forbidden(fldPath.Child("labels").Key(k), "reserved by the operator")
+		}
+	}
+	for k := range o.Annotations {
+		if strings.HasPrefix(k, reservedPrefix) {
+			return field.Forbidden(fldPath.Child("annotations").Key(k), "reserved by the operator")
+		}
+	}
+
+	return nil
+}
+
+func validateSnapshotDestination(dest *SnapshotDestination, fldPath *field.Path) *field.Error {
+	if dest == nil {
+		return nil
+	}
+
+	switch {
+	case dest.PVC != nil && dest.S3 != nil:
+		return field.Invalid(fldPath, "pvc, s3", "only one of pvc and s3 may be set")
+	case dest.PVC != nil:
+		if dest.PVC.ClaimName == "" {
+			return field.Required(fldPath.Child("pvc", "claimName"), "")
+		}
+	case dest.S3 != nil:
+		if dest.S3.Bucket == "" {
+			return field.Required(fldPath.Child("s3", "bucket"), "")
+		}
+	default:
+		return field.Required(fldPath, "one of pvc and s3 must be set")
+	}
+
 	return nil
 }
 
@@ -5,6 +5,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 func TestQuantityToInt(t *testing.T) {
@@ -34,3 +37,226 @@ func TestDefault(t *testing.T) {
 
 	assert.Equal(t, 3, in.Spec.Members)
 }
+
+func TestValidateSnapshotDestination(t *testing.T) {
+	fldPath := field.NewPath("spec").Child("upgrade", "snapshot")
+
+	assert.Nil(t, validateSnapshotDestination(nil, fldPath))
+	assert.Nil(t, validateSnapshotDestination(&SnapshotDestination{PVC: &PVCDestination{ClaimName: "backup"}}, fldPath))
+	assert.Nil(t, validateSnapshotDestination(&SnapshotDestination{S3: &S3Destination{Bucket: "backup"}}, fldPath))
+
+	assert.NotNil(t, validateSnapshotDestination(&SnapshotDestination{}, fldPath))
+	assert.NotNil(t, validateSnapshotDestination(&SnapshotDestination{PVC: &PVCDestination{}}, fldPath))
+	assert.NotNil(t, validateSnapshotDestination(&SnapshotDestination{
+		PVC: &PVCDestination{ClaimName: "backup"},
+		S3:  &S3Destination{Bucket: "backup"},
+	}, fldPath))
+}
+
+func TestValidateStorageUpdate(t *testing.T) {
+	newCr := func(storage string) *Etcd {
+		return &Etcd{
+			Spec: EtcdSpec{
+				Storage: storage,
+			},
+		}
+	}
+
+	assert.Nil(t, newCr("10Gi").validateStorageUpdate(newCr("10Gi")))
+	assert.Nil(t, newCr("10240Mi").validateStorageUpdate(newCr("10Gi")))
+	assert.Nil(t, newCr("20Gi").validateStorageUpdate(newCr("10Gi")))
+
+	assert.NotNil(t, newCr("5Gi").validateStorageUpdate(newCr("10Gi")))
+	assert.NotNil(t, newCr("").validateStorageUpdate(newCr("10Gi")))
+	assert.NotNil(t, newCr("10Gi").validateStorageUpdate(newCr("")))
+
+	tests := []struct {
+		name     string
+		old, new string
+		errType  field.ErrorType
+	}{
+		{name: "shrink", old: "10Gi", new: "5Gi", errType: field.ErrorTypeForbidden},
+		{name: "invalid new", old: "10Gi", new: "10GB", errType: field.ErrorTypeInvalid},
+		{name: "invalid old", old: "ten", new: "10Gi", errType: field.ErrorTypeInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newCr(tt.new).validateStorageUpdate(newCr(tt.old))
+			require.NotNil(t, err)
+			assert.Equal(t, tt.errType, err.Type)
+			assert.Equal(t, "spec.storage", err.Field)
+		})
+	}
+
+	t.Run("grow", func(t *testing.T) {
+		assert.Nil(t, newCr("1Ti").validateStorageUpdate(newCr("10Gi")))
+	})
+}
+
+func TestValidateWalStorageUpdate(t *testing.T) {
+	newCr := func(wal *WalStorage) *Etcd {
+		return &Etcd{
+			Spec: EtcdSpec{
+				Storage:    "10Gi",
+				WalStorage: wal,
+			},
+		}
+	}
+
+	assert.Nil(t, newCr(nil).validateStorageUpdate(newCr(nil)))
+	assert.Nil(t, newCr(&WalStorage{Size: "2Gi", StorageClassName: "ssd"}).validateStorageUpdate(newCr(&WalStorage{Size: "1Gi", StorageClassName: "ssd"})))
+
+	assert.NotNil(t, newCr(&WalStorage{Size: "1Gi"}).validateStorageUpdate(newCr(nil)))
+	assert.NotNil(t, newCr(nil).validateStorageUpdate(newCr(&WalStorage{Size: "1Gi"})))
+	assert.NotNil(t, newCr(&WalStorage{Size: "1Gi", StorageClassName: "hdd"}).validateStorageUpdate(newCr(&WalStorage{Size: "1Gi", StorageClassName: "ssd"})))
+	assert.NotNil(t, newCr(&WalStorage{Size: "512Mi", StorageClassName: "ssd"}).validateStorageUpdate(newCr(&WalStorage{Size: "1Gi", StorageClassName: "ssd"})))
+
+	err := newCr(&WalStorage{Size: "1gb", StorageClassName: "ssd"}).validateStorageUpdate(newCr(&WalStorage{Size: "1Gi", StorageClassName: "ssd"}))
+	require.NotNil(t, err)
+	assert.Equal(t, field.ErrorTypeInvalid, err.Type)
+	assert.Equal(t, "spec.walStorage.size", err.Field)
+}
+
+func TestValidateDeletionPolicy(t *testing.T) {
+	in := &Etcd{}
+	in.Default()
+	assert.Equal(t, DeletionPolicyDelete, in.Spec.DeletionPolicy)
+
+	in.Spec.DeletionPolicy = DeletionPolicySnapshot
+	assert.NotNil(t, in.validateSpec())
+
+	in.Spec.DeletionSnapshot = &SnapshotDestination{PVC: &PVCDestination{ClaimName: "backup"}}
+	assert.Nil(t, in.validateSpec())
+}
+
+func TestValidateDelete(t *testing.T) {
+	in := &Etcd{}
+	assert.Nil(t, in.ValidateDelete())
+
+	in.Spec.DeletionProtection = true
+	assert.NotNil(t, in.ValidateDelete())
+
+	in.Spec.DeletionProtection = false
+	in.Annotations = map[string]string{AnnotationDeletionProtection: "true"}
+	assert.NotNil(t, in.ValidateDelete())
+}
+
+func TestKubeApiserverClient(t *testing.T) {
+	in := &Etcd{}
+	in.Spec.KubeApiserverClient = &KubeApiserverClientSpec{}
+	in.Default()
+	assert.True(t, in.TLSEnabled())
+	assert.Equal(t, KubeApiserverClientCN, in.Spec.KubeApiserverClient.CommonName)
+	assert.Nil(t, in.validateSpec())
+
+	in.Spec.TLS.Enabled = false
+	assert.NotNil(t, in.validateSpec())
+
+	// added to a cluster without TLS
+	old := &Etcd{}
+	old.Name = "foo"
+	old.Default()
+	for _, tls := range []*TLSSpec{nil, {Enabled: false}} {
+		in := old.DeepCopy()
+		in.Spec.TLS = tls
+		in.Spec.KubeApiserverClient = &KubeApiserverClientSpec{}
+		in.Default()
+
+		err := in.ValidateUpdate(old)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "spec.kubeApiserverClient")
+		assert.Contains(t, err.Error(), "client TLS requires server TLS")
+	}
+}
+
+func TestValidateConnectionSecret(t *testing.T) {
+	in := &Etcd{}
+	in.Name = "foo"
+	in.Default()
+	assert.Equal(t, "foo-connection", in.Spec.ConnectionSecret)
+	assert.Nil(t, in.validateSpec())
+
+	for _, name := range []string{"foo-ca", "foo-server-tls", "foo-client-tls", "foo-auth"} {
+		in.Spec.ConnectionSecret = name
+		assert.NotNil(t, in.validateSpec(), name)
+	}
+
+	in.Spec.ConnectionSecret = "app-etcd"
+	in.Spec.KubeApiserverClient = &KubeApiserverClientSpec{SecretName: "app-etcd"}
+	in.Spec.TLS = &TLSSpec{Enabled: true}
+	assert.NotNil(t, in.validateSpec())
+}
+
+func TestValidatePlacement(t *testing.T) {
+	in := &Etcd{}
+	in.Spec.Members = 3
+	in.Spec.Placement = &Placement{TopologyKeys: []string{TopologyKeyZone}}
+	assert.Nil(t, in.validateSpec())
+	assert.Equal(t, 3, in.ZonesNeeded())
+
+	in.Spec.Members = 5
+	assert.Equal(t, 3, in.ZonesNeeded())
+	in.Spec.Members = 3
+
+	in.Spec.Placement.TopologyKeys = append(in.Spec.Placement.TopologyKeys, "rack")
+	assert.NotNil(t, in.validateSpec())
+}
+
+func TestValidateOverrides(t *testing.T) {
+	in := &Etcd{}
+	in.Spec.Overrides = &Overrides{
+		StatefulSet: &runtime.RawExtension{Raw: []byte(`{"spec": {"template": {"spec": {"priorityClassName": "high"}}}}`)},
+	}
+	assert.Nil(t, in.validateSpec())
+
+	in.Spec.Overrides.Services = &runtime.RawExtension{Raw: []byte(`{"spec": {"ports": "2379"}}`)}
+	assert.NotNil(t, in.validateSpec())
+
+	in.Spec.Overrides.Services = nil
+	for _, raw := range []string{
+		`{"spec": {"template": {"spec": {"containers": [{"name": "etcd", "$patch": "delete"}]}}}}`,
+		`{"spec": {"template": {"spec": {"volumes": [{"name": "tls"}], "$patch": "replace"}}}}`,
+		`{"spec": {"template": {"spec": {"$setElementOrder/containers": [{"name": "sidecar"}]}}}}`,
+	} {
+		in.Spec.Overrides.StatefulSet = &runtime.RawExtension{Raw: []byte(raw)}
+		assert.NotNil(t, in.validateSpec(), raw)
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	in := &Etcd{}
+	in.Spec.Metadata = &ResourceMetadata{
+		ObjectMetadata: ObjectMetadata{Labels: map[string]string{"cost-center": "db"}},
+		Pods:           &ObjectMetadata{Annotations: map[string]string{"sidecar.istio.io/inject": "false"}},
+	}
+	assert.Nil(t, in.validateSpec())
+
+	in.Spec.Metadata.Pods.Labels = map[string]string{"role": "other"}
+	assert.NotNil(t, in.validateSpec())
+
+	in.Spec.Metadata.Pods.Labels = nil
+	in.Spec.Metadata.Services = &ObjectMetadata{Annotations: map[string]string{"etcd-operator/spec-hash": "x"}}
+	assert.NotNil(t, in.validateSpec())
+
+	in.Spec.Metadata.Services = nil
+	in.Spec.Metadata.Labels["bad key!"] = "v"
+	assert.NotNil(t, in.validateSpec())
+}
+
+func TestValidateMonitoring(t *testing.T) {
+	in := &Etcd{}
+	in.Spec.Monitoring = &MonitoringSpec{ScrapeLabels: map[string]string{"cluster": "prod"}}
+	in.Default()
+	assert.Equal(t, ServiceMonitor, in.Spec.Monitoring.Kind)
+	assert.Nil(t, in.validateSpec())
+
+	in.Spec.Monitoring.ScrapeLabels["bad-label"] = "x"
+	assert.NotNil(t, in.validateSpec())
+
+	delete(in.Spec.Monitoring.ScrapeLabels, "bad-label")
+	in.Spec.Monitoring.TLS = true
+	assert.NotNil(t, in.validateSpec())
+
+	in.Spec.TLS = &TLSSpec{Enabled: true}
+	assert.Nil(t, in.validateSpec())
+}
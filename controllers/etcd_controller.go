@@ -21,29 +21,43 @@ import (
 
 	"go.uber.org/zap"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	dbv1 "github.com/win5do/etcd-operator/api/v1"
 	"github.com/win5do/etcd-operator/pkg/conf"
 	"github.com/win5do/etcd-operator/pkg/controller"
+	"github.com/win5do/etcd-operator/pkg/metrics"
 	"github.com/win5do/etcd-operator/pkg/rerr"
 )
 
 // EtcdReconciler reconciles a Etcd object
 type EtcdReconciler struct {
 	client.Client
-	Log    *zap.SugaredLogger
-	Scheme *runtime.Scheme
+	// APIReader reads around the cache
+	APIReader client.Reader
+	Log       *zap.SugaredLogger
+	Scheme    *runtime.Scheme
+	Recorder  record.EventRecorder
+
+	backoff *rerr.Backoff
 }
 
 // +kubebuilder:rbac:groups=db.gogo.io,resources=etcds,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=db.gogo.io,resources=etcds/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=db.gogo.io,resources=etcds/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -60,37 +74,95 @@ func (r *EtcdReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 			// Request object not found, could have been deleted after reconcile request.
 			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
 			// Return and don't requeue
+			r.backoff.Reset(req.NamespacedName.String())
 			return ctrl.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
 		return ctrl.Result{}, err
 	}
 
-	return r.reconcile(rlog, cr)
+	return r.reconcile(ctx, rlog, cr)
 }
 
-// SetupWithManager sets up the controller with the Manager.
-func (r *EtcdReconciler) SetupWithManager(mgr ctrl.Manager) error {
+// SetupWithManager sets up the controller with the Manager. ctx is the one the manager runs with.
+func (r *EtcdReconciler) SetupWithManager(ctx context.Context, mgr ctrl.Manager) error {
+	r.backoff = rerr.NewBackoff()
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&dbv1.Etcd{}).
 		Owns(&appsv1.StatefulSet{}).
-		Owns(&corev1.Pod{}).
+		Owns(&corev1.Secret{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&policyv1beta1.PodDisruptionBudget{}).
+		Owns(&batchv1.Job{}).
+		// pods are owned by the sts, PVCs by nobody, map them back by label
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(r.mapToCR(ctx))).
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.mapToCR(ctx))).
+		Watches(&source.Kind{Type: &corev1.PersistentVolumeClaim{}}, handler.EnqueueRequestsFromMapFunc(r.mapToCR(ctx))).
 		Complete(r)
 }
 
-func (r *EtcdReconciler) reconcile(rlog *zap.SugaredLogger, cr *dbv1.Etcd) (reconcile.Result, error) {
-	herr := rerr.NewHandler(rlog)
+// mapToCR the cr named by cr-name, objects left by a deleted cr of the same name are dropped by cr-uid
+func (r *EtcdReconciler) mapToCR(ctx context.Context) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		labels := obj.GetLabels()
+		name, uid := labels[controller.LabelCrName], labels[controller.LabelCrUID]
+		if name == "" || uid == "" {
+			return nil
+		}
+
+		key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}
+		cr := &dbv1.Etcd{}
+		err := r.Get(ctx, key, cr)
+		if err != nil || string(cr.UID) != uid {
+			return nil
+		}
 
-	ct := controller.Inject(r.Client, r.Scheme, cr, rlog, conf.GetGlobalConfig())
+		return []reconcile.Request{{NamespacedName: key}}
+	}
+}
+
+func (r *EtcdReconciler) reconcile(ctx context.Context, rlog *zap.SugaredLogger, cr *dbv1.Etcd) (result reconcile.Result, err error) {
+	herr := rerr.NewHandler(rlog, r.Recorder, cr, r.backoff)
+
+	ct := controller.Inject(ctx, r.Client, r.APIReader, r.Scheme, cr, rlog, conf.GetGlobalConfig(), r.Recorder)
+	herr.OnPermanent = ct.SetDegraded
+
+	// one status write per reconcile, after the error handler had its say
+	defer func() {
+		ferr := ct.FlushStatus()
+		if ferr == nil {
+			return
+		}
+
+		rlog.Warnf("flush status: %+v", ferr)
+		if !result.Requeue {
+			result, err = herr.HandleErr(ferr)
+		}
+	}()
 
 	// ---> delete & clean
 	{
 		if cr.GetDeletionTimestamp() != nil {
-			err := ct.Finalize()
+			err := metrics.Time("finalize", ct.Finalize)
+			if err != nil {
+				return herr.HandleErr(err)
+			}
+
+			// the cr goes away with the finalizer, so does its backoff
+			r.backoff.Reset(client.ObjectKeyFromObject(cr).String())
+			return ctrl.Result{}, nil
+		}
+
+		err := metrics.Time("finalizer", ct.AddFinalizer)
+		if err != nil {
 			return herr.HandleErr(err)
 		}
+	}
 
-		err := ct.AddFinalizer()
+	// ---> overrides must keep what the members rely on
+	{
+		err := ct.CheckOverrides()
 		if err != nil {
 			return herr.HandleErr(err)
 		}
@@ -98,7 +170,7 @@ func (r *EtcdReconciler) reconcile(rlog *zap.SugaredLogger, cr *dbv1.Etcd) (reco
 
 	// ---> sync svc
 	{
-		err := ct.SyncSvc()
+		err := metrics.Time("svc", ct.SyncSvc)
 		if err != nil {
 			return herr.HandleErr(err)
 		}
@@ -106,47 +178,137 @@ func (r *EtcdReconciler) reconcile(rlog *zap.SugaredLogger, cr *dbv1.Etcd) (reco
 
 	// ---> headless svc, work fine with p8s
 	{
-		err := ct.Kcli.EnsureService(ct.Builder.HeadlessService(
-			cr.Name,
-			controller.MemberLabel(cr.ObjectMeta, controller.SelectAll),
-			controller.MemberLabel(cr.ObjectMeta, controller.SelectAll),
-		))
+		err := metrics.Time("headless", func() error {
+			return ct.SyncService(ct.Builder.HeadlessService(
+				cr.Name,
+				controller.MemberLabel(cr.ObjectMeta, controller.SelectAll),
+				controller.MemberLabel(cr.ObjectMeta, controller.SelectAll),
+			))
+		})
 		if err != nil {
 			return herr.HandleErr(err)
 		}
 	}
 
-	// ---> sync sts
+	// ---> certs mounted by the members
+	{
+		err := metrics.Time("tls", ct.SyncTLS)
+		if err != nil {
+			return herr.HandleErr(err)
+		}
+	}
+
+	// ---> adopt PVCs retained by an earlier cluster of the same name
+	{
+		err := metrics.Time("adoption", ct.SyncAdoption)
+		if err != nil {
+			return herr.HandleErr(err)
+		}
+	}
+
+	// ---> expand PVCs, sts is recreated since VolumeClaimTemplates are immutable
+	{
+		err := metrics.Time("storage", ct.SyncStorage)
+		if err != nil {
+			return herr.HandleErr(err)
+		}
+	}
+
+	// ---> upgrade one member at a time, before sts picks up the image
 	{
-		newSts := ct.Builder.StatefulSet(controller.MemberLabel(cr.ObjectMeta, controller.SelectAll))
-		oldSts := &appsv1.StatefulSet{}
-		err := ct.Kcli.Ensure(newSts, oldSts)
+		err := metrics.Time("upgrade", ct.SyncUpgrade)
 		if err != nil {
 			return herr.HandleErr(err)
 		}
+	}
 
-		if oldSts.UID != "" {
-			if oldSts.Annotations[controller.SpecHash] != newSts.Annotations[controller.SpecHash] {
-				err := ct.Kcli.PatchObject(oldSts, &appsv1.StatefulSet{
-					ObjectMeta: newSts.ObjectMeta,
-					Spec:       newSts.Spec,
-				})
-				if err != nil {
-					return herr.HandleErr(err)
-				}
+	// ---> sync sts
+	{
+		err := metrics.Time("sts", func() error {
+			newSts := ct.Builder.StatefulSet(controller.MemberLabel(cr.ObjectMeta, controller.SelectAll))
+			oldSts := &appsv1.StatefulSet{}
+			exists, err := ct.Kcli.IsExists(ctx, newSts, oldSts)
+			if err != nil {
+				return err
+			}
+			if exists {
+				// VolumeClaimTemplates are immutable, metadata of the existing PVCs is synced by SyncStorage
+				newSts.Spec.VolumeClaimTemplates = oldSts.Spec.VolumeClaimTemplates
+				// immutable too, sts created before Parallel keep their policy
+				newSts.Spec.PodManagementPolicy = oldSts.Spec.PodManagementPolicy
 			}
+
+			err = ct.Kcli.Apply(ctx, newSts)
+			if err != nil {
+				return err
+			}
+
+			if exists && newSts.Generation != oldSts.Generation {
+				ct.Kcli.Event(corev1.EventTypeNormal, controller.ReasonRollingUpdate, "spec of StatefulSet %s changed, members roll", newSts.Name)
+			}
+			return nil
+		})
+		if err != nil {
+			return herr.HandleErr(err)
 		}
 	}
 
-	// ---> set status
+	// ---> prometheus monitor of the members
 	{
-		nodePorts, err := ct.ListSvcNodePort(controller.PortClientName, cr.Namespace, controller.ExportSvcLabel(cr.ObjectMeta, controller.SelectAll))
+		err := metrics.Time("monitor", ct.SyncMonitor)
 		if err != nil {
 			return herr.HandleErr(err)
 		}
-		rlog.Debugf("nodePorts: %v", nodePorts)
+	}
+
+	// ---> prometheus alerts of the cluster
+	{
+		err := metrics.Time("alerts", ct.SyncAlerts)
+		if err != nil {
+			return herr.HandleErr(err)
+		}
+	}
+
+	// ---> pdb, keep quorum through node drains
+	{
+		err := metrics.Time("pdb", ct.SyncPDB)
+		if err != nil {
+			return herr.HandleErr(err)
+		}
+	}
+
+	// ---> enable or disable auth once members are up
+	{
+		err := metrics.Time("auth", ct.SyncAuth)
+		if err != nil {
+			return herr.HandleErr(err)
+		}
+	}
+
+	// ---> client cert of a kube-apiserver using the cluster as external storage
+	{
+		err := metrics.Time("apiserver", ct.SyncKubeApiserverClient)
+		if err != nil {
+			return herr.HandleErr(err)
+		}
+	}
+
+	// ---> set status
+	{
+		err := metrics.Time("status", func() error {
+			addrs, err := ct.ListSvcAddr()
+			if err != nil {
+				return err
+			}
+			rlog.Debugf("connect addrs: %v", addrs)
+
+			err = ct.SyncConnectionSecret(addrs)
+			if err != nil {
+				return err
+			}
 
-		err = ct.StatusManager.HandleStatus(cr, nodePorts)
+			return ct.StatusManager.HandleStatus(ctx, cr, addrs)
+		})
 		if err != nil {
 			return herr.HandleErr(err)
 		}
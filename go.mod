@@ -9,9 +9,12 @@ require (
 	github.com/onsi/gomega v1.10.5
 	github.com/open-policy-agent/cert-controller v0.1.1-0.20210308205344-203624759536
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/stretchr/testify v1.7.0
 	github.com/win5do/go-lib v0.0.0-20210322065409-edc6813f5414
-	go.uber.org/zap v1.16.0
+	go.etcd.io/etcd/api/v3 v3.5.0
+	go.etcd.io/etcd/client/v3 v3.5.0
+	go.uber.org/zap v1.17.0
 	k8s.io/api v0.20.2
 	k8s.io/apimachinery v0.20.2
 	k8s.io/client-go v0.20.2
@@ -20,6 +20,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/go-logr/zapr"
 	"github.com/win5do/go-lib/logx"
@@ -37,9 +38,14 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	czap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	dbv1 "github.com/win5do/etcd-operator/api/v1"
 	"github.com/win5do/etcd-operator/controllers"
+	"github.com/win5do/etcd-operator/pkg/admission"
+	"github.com/win5do/etcd-operator/pkg/cache"
+	"github.com/win5do/etcd-operator/pkg/controller"
 	"github.com/win5do/etcd-operator/pkg/k8s"
 	// +kubebuilder:scaffold:imports
 )
@@ -59,6 +65,10 @@ var (
 			Name: "etcd-operator-mutating-webhook-config",
 			Type: rotator.Mutating,
 		},
+		{
+			Name: "etcd-operator-pod-injector",
+			Type: rotator.Mutating,
+		},
 	}
 )
 
@@ -67,6 +77,9 @@ const (
 	serviceName    = "etcd-operator-webhook"
 	caName         = "etcd-operator-ca"
 	caOrganization = "etcd-operator"
+
+	// ServiceAccount the operator runs as, see config/rbac/service-account.yaml
+	serviceAccountName = "etcd-operator"
 )
 
 func init() {
@@ -109,6 +122,8 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "a73bd0c8.gogo.io",
+		// only objects created by the operator, not every Pod, Service and Secret of the cluster
+		NewCache: cache.New(controller.CacheSelectors()),
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -139,25 +154,45 @@ func main() {
 		close(setupFinished)
 	}
 
+	ctx := ctrl.SetupSignalHandler()
+
 	go func() {
 		<-setupFinished
 
 		err := (&controllers.EtcdReconciler{
-			Client: mgr.GetClient(),
-			Log:    zaplog.Sugar().Named("controllers").Named("Etcd"),
-			Scheme: mgr.GetScheme(),
-		}).SetupWithManager(mgr)
+			Client:    mgr.GetClient(),
+			APIReader: mgr.GetAPIReader(),
+			Log:       zaplog.Sugar().Named("controllers").Named("Etcd"),
+			Scheme:    mgr.GetScheme(),
+			// 3s requeue 期间不重复发相同的 event
+			Recorder: k8s.NewDedupRecorder(mgr.GetEventRecorderFor("etcd-operator"), 5*time.Minute),
+		}).SetupWithManager(ctx, mgr)
 		if err != nil {
 			setupLog.Error(err, "unable to create controller", "controller", "Etcd")
 			os.Exit(1)
 		}
 
+		metrics.Registry.MustRegister(&controller.ClusterCollector{Reader: mgr.GetClient()})
+
 		if certDir != "" {
 			err = (&dbv1.Etcd{}).SetupWebhookWithManager(mgr)
 			if err != nil {
 				setupLog.Error(err, "unable to SetupWebhookWithManager")
 				os.Exit(1)
 			}
+
+			mgr.GetWebhookServer().Register(admission.DeletionProtectionPath, &webhook.Admission{
+				Handler: &admission.DeletionProtection{
+					Client:   mgr.GetAPIReader(),
+					Operator: fmt.Sprintf("system:serviceaccount:%s:%s", k8s.GetOperatorNamespace(), serviceAccountName),
+				},
+			})
+
+			mgr.GetWebhookServer().Register(admission.InjectPath, &webhook.Admission{
+				Handler: &admission.Injector{
+					Client: mgr.GetAPIReader(),
+				},
+			})
 		}
 	}()
 
@@ -173,7 +208,7 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
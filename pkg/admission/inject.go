@@ -0,0 +1,187 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	log "github.com/win5do/go-lib/logx"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/controller"
+)
+
+const (
+	InjectPath = "/mutate-v1-pod"
+
+	// AnnotationInject names the Etcd, in the Pod's namespace, whose connection settings are injected
+	AnnotationInject = "etcd.gogo.io/inject"
+
+	injectVolumeName = "etcd-client-tls"
+	injectMountPath  = "/var/run/secrets/etcd.gogo.io"
+)
+
+// Injector sets ETCDCTL_* env vars on annotated Pods from the connection Secret of the cluster,
+// and mounts the CA and client cert when TLS is on.
+type Injector struct {
+	Client client.Reader
+
+	decoder *admission.Decoder
+}
+
+var _ admission.Handler = &Injector{}
+var _ admission.DecoderInjector = &Injector{}
+
+func (s *Injector) InjectDecoder(d *admission.Decoder) error {
+	s.decoder = d
+	return nil
+}
+
+func (s *Injector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	err := s.decoder.Decode(req, pod)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	name := pod.Annotations[AnnotationInject]
+	if name == "" {
+		return admission.Allowed("")
+	}
+
+	cr := &dbv1.Etcd{}
+	err = s.Client.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: name}, cr)
+	if err != nil {
+		if k8serr.IsNotFound(err) {
+			return admission.Denied(fmt.Sprintf("etcd %s in %s annotation not found in namespace %s", name, AnnotationInject, req.Namespace))
+		}
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	InjectPod(pod, cr)
+
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	log.Debugf("inject etcd %s into pod %s/%s", name, req.Namespace, pod.GetName()+pod.GetGenerateName())
+	return admission.PatchResponseFromRaw(req.Object.Raw, raw)
+}
+
+// InjectPod is idempotent, settings already present on a container are left alone
+func InjectPod(pod *corev1.Pod, cr *dbv1.Etcd) {
+	env := injectEnv(cr)
+
+	for i := range pod.Spec.InitContainers {
+		injectContainer(&pod.Spec.InitContainers[i], env, cr.TLSEnabled())
+	}
+	for i := range pod.Spec.Containers {
+		injectContainer(&pod.Spec.Containers[i], env, cr.TLSEnabled())
+	}
+
+	if !cr.TLSEnabled() || hasVolume(pod.Spec.Volumes, injectVolumeName) {
+		return
+	}
+
+	var items []corev1.KeyToPath
+	for _, k := range []string{controller.CACertKey, corev1.TLSCertKey, corev1.TLSPrivateKeyKey} {
+		items = append(items, corev1.KeyToPath{Key: k, Path: k})
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: injectVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: cr.ConnectionSecretName(),
+				Items:      items,
+			},
+		},
+	})
+}
+
+func injectEnv(cr *dbv1.Etcd) []corev1.EnvVar {
+	secret := corev1.LocalObjectReference{Name: cr.ConnectionSecretName()}
+	fromSecret := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: secret,
+				Key:                  key,
+			},
+		}
+	}
+
+	r := []corev1.EnvVar{
+		{Name: "ETCDCTL_API", Value: "3"},
+		{Name: "ETCDCTL_ENDPOINTS", ValueFrom: fromSecret("endpoints")},
+	}
+
+	if cr.TLSEnabled() {
+		r = append(r,
+			corev1.EnvVar{Name: "ETCDCTL_CACERT", Value: path.Join(injectMountPath, controller.CACertKey)},
+			corev1.EnvVar{Name: "ETCDCTL_CERT", Value: path.Join(injectMountPath, corev1.TLSCertKey)},
+			corev1.EnvVar{Name: "ETCDCTL_KEY", Value: path.Join(injectMountPath, corev1.TLSPrivateKeyKey)},
+		)
+	}
+
+	if cr.AuthEnabled() {
+		r = append(r,
+			corev1.EnvVar{Name: "ETCDCTL_USER", ValueFrom: fromSecret(corev1.BasicAuthUsernameKey)},
+			corev1.EnvVar{Name: "ETCDCTL_PASSWORD", ValueFrom: fromSecret(corev1.BasicAuthPasswordKey)},
+		)
+	}
+
+	return r
+}
+
+func injectContainer(c *corev1.Container, env []corev1.EnvVar, tls bool) {
+	for _, v := range env {
+		if hasEnv(c.Env, v.Name) {
+			continue
+		}
+		c.Env = append(c.Env, v)
+	}
+
+	if !tls {
+		return
+	}
+
+	for _, v := range c.VolumeMounts {
+		if v.Name == injectVolumeName {
+			return
+		}
+	}
+
+	c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+		Name:      injectVolumeName,
+		MountPath: injectMountPath,
+		ReadOnly:  true,
+	})
+}
+
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, v := range env {
+		if v.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasVolume(volumes []corev1.Volume, name string) bool {
+	for _, v := range volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,102 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/test"
+)
+
+func TestInjectPod(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			TLS:  &dbv1.TLSSpec{Enabled: true},
+			Auth: &dbv1.AuthSpec{Enabled: true},
+		},
+	}
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					Env:  []corev1.EnvVar{{Name: "ETCDCTL_API", Value: "2"}},
+				},
+			},
+		},
+	}
+
+	InjectPod(pod, cr)
+	InjectPod(pod, cr)
+
+	c := pod.Spec.Containers[0]
+	require.Len(t, c.Env, 7)
+	require.Equal(t, "2", c.Env[0].Value)
+	require.Equal(t, "foo-connection", c.Env[1].ValueFrom.SecretKeyRef.Name)
+	require.Len(t, c.VolumeMounts, 1)
+	require.Len(t, pod.Spec.Volumes, 1)
+	require.Equal(t, "foo-connection", pod.Spec.Volumes[0].Secret.SecretName)
+}
+
+func TestInjector(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+	}
+
+	decoder, err := admission.NewDecoder(kubescheme.Scheme)
+	require.NoError(t, err)
+	h := &Injector{
+		Client: fake.NewClientBuilder().WithScheme(test.Kscheme()).WithObjects(cr).Build(),
+	}
+	require.NoError(t, h.InjectDecoder(decoder))
+
+	request := func(annotations map[string]string) admission.Request {
+		raw, err := json.Marshal(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Annotations: annotations,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app"}},
+			},
+		})
+		require.NoError(t, err)
+
+		return admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		}
+	}
+	ctx := context.Background()
+
+	resp := h.Handle(ctx, request(nil))
+	require.True(t, resp.Allowed)
+	require.Empty(t, resp.Patches)
+
+	resp = h.Handle(ctx, request(map[string]string{AnnotationInject: "foo"}))
+	require.True(t, resp.Allowed)
+	require.NotEmpty(t, resp.Patches)
+
+	resp = h.Handle(ctx, request(map[string]string{AnnotationInject: "bar"}))
+	require.False(t, resp.Allowed)
+}
@@ -0,0 +1,69 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/win5do/go-lib/logx"
+	admissionv1 "k8s.io/api/admission/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/controller"
+)
+
+const DeletionProtectionPath = "/validate-etcd-owned-delete"
+
+// DeletionProtection rejects direct deletes of the StatefulSet and PVCs of a protected Etcd
+type DeletionProtection struct {
+	Client client.Reader
+
+	// Operator is the username of the operator, it may still delete e.g. to recreate the StatefulSet
+	Operator string
+}
+
+var _ admission.Handler = &DeletionProtection{}
+
+func (s *DeletionProtection) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Delete || req.UserInfo.Username == s.Operator {
+		return admission.Allowed("")
+	}
+
+	obj := &metav1.PartialObjectMetadata{}
+	err := json.Unmarshal(req.OldObject.Raw, obj)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	name := obj.Labels[controller.LabelCrName]
+	if name == "" {
+		return admission.Allowed("")
+	}
+
+	cr := &dbv1.Etcd{}
+	err = s.Client.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: name}, cr)
+	if err != nil {
+		if k8serr.IsNotFound(err) {
+			return admission.Allowed("")
+		}
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	// labelled by an earlier cluster of the same name
+	if obj.Labels[controller.LabelCrUID] != string(cr.UID) {
+		return admission.Allowed("")
+	}
+
+	if !cr.DeletionProtected() {
+		return admission.Allowed("")
+	}
+
+	log.Infof("deny delete %s %s/%s, etcd %s is protected", req.Kind.Kind, req.Namespace, req.Name, cr.Name)
+	return admission.Denied(fmt.Sprintf("%s %s belongs to etcd %s which has deletion protection enabled", req.Kind.Kind, req.Name, cr.Name))
+}
@@ -0,0 +1,66 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/test"
+)
+
+func deleteRequest(t *testing.T, username string, labels map[string]string) admission.Request {
+	raw, err := json.Marshal(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Labels:    labels,
+		},
+	})
+	require.NoError(t, err)
+
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Delete,
+			Namespace: "default",
+			Name:      "foo",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+			UserInfo:  authenticationv1.UserInfo{Username: username},
+			OldObject: runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+func TestDeletionProtection(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			UID:       "uid-1",
+		},
+		Spec: dbv1.EtcdSpec{
+			DeletionProtection: true,
+		},
+	}
+
+	h := &DeletionProtection{
+		Client:   fake.NewClientBuilder().WithScheme(test.Kscheme()).WithObjects(cr).Build(),
+		Operator: "system:serviceaccount:etcd-operator-system:etcd-operator",
+	}
+	ctx := context.Background()
+	owned := map[string]string{"cr-name": "foo", "cr-uid": "uid-1"}
+
+	require.False(t, h.Handle(ctx, deleteRequest(t, "admin", owned)).Allowed)
+	require.True(t, h.Handle(ctx, deleteRequest(t, h.Operator, owned)).Allowed)
+	require.True(t, h.Handle(ctx, deleteRequest(t, "admin", map[string]string{"cr-name": "foo", "cr-uid": "uid-0"})).Allowed)
+	require.True(t, h.Handle(ctx, deleteRequest(t, "admin", nil)).Allowed)
+}
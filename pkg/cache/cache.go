@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+	crcache "sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// Selectors label selector of the objects to cache, by group and resource
+type Selectors map[schema.GroupResource]string
+
+// New a cache.NewCacheFunc that lists and watches the resources in selectors with their label selector,
+// other objects of those kinds are neither cached nor found by reads through the cache.
+// controller-runtime before v0.9 has no per-object selectors, so they are added to the requests of the informers
+func New(selectors Selectors) crcache.NewCacheFunc {
+	return func(config *rest.Config, opts crcache.Options) (crcache.Cache, error) {
+		config = rest.CopyConfig(config)
+		config.WrapTransport = transport.Wrappers(config.WrapTransport, func(rt http.RoundTripper) http.RoundTripper {
+			return &selectorTransport{next: rt, selectors: selectors}
+		})
+
+		return crcache.New(config, opts)
+	}
+}
+
+type selectorTransport struct {
+	next      http.RoundTripper
+	selectors Selectors
+}
+
+func (s *selectorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return s.next.RoundTrip(req)
+	}
+
+	gr, ok := collectionResource(req.URL.Path)
+	if !ok {
+		return s.next.RoundTrip(req)
+	}
+
+	selector := s.selectors[gr]
+	if selector == "" {
+		return s.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	q := req.URL.Query()
+	if v := q.Get("labelSelector"); v != "" {
+		selector = v + "," + selector
+	}
+	q.Set("labelSelector", selector)
+	req.URL.RawQuery = q.Encode()
+
+	return s.next.RoundTrip(req)
+}
+
+// collectionResource group and resource of a list or watch path, e.g. /api/v1/namespaces/default/pods
+// or /apis/apps/v1/statefulsets. The host may add a prefix, e.g. a proxy to the API server
+func collectionResource(path string) (schema.GroupResource, bool) {
+	seg := strings.Split(strings.Trim(path, "/"), "/")
+
+	for i, v := range seg {
+		var group string
+		var tail []string
+
+		switch v {
+		case "api":
+			// api/v1/...
+			tail = seg[i+1:]
+		case "apis":
+			// apis/group/v1/...
+			if len(seg) < i+2 {
+				return schema.GroupResource{}, false
+			}
+			group = seg[i+1]
+			tail = seg[i+2:]
+		default:
+			continue
+		}
+
+		switch {
+		case len(tail) == 2:
+			return schema.GroupResource{Group: group, Resource: tail[1]}, true
+		case len(tail) == 4 && tail[1] == "namespaces":
+			return schema.GroupResource{Group: group, Resource: tail[3]}, true
+		default:
+			return schema.GroupResource{}, false
+		}
+	}
+
+	return schema.GroupResource{}, false
+}
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	crcache "sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCollectionResource(t *testing.T) {
+	cases := []struct {
+		path string
+		gr   schema.GroupResource
+		ok   bool
+	}{
+		{"/api/v1/pods", schema.GroupResource{Resource: "pods"}, true},
+		{"/api/v1/namespaces/default/pods", schema.GroupResource{Resource: "pods"}, true},
+		{"/apis/apps/v1/statefulsets", schema.GroupResource{Group: "apps", Resource: "statefulsets"}, true},
+		{"/apis/apps/v1/namespaces/default/statefulsets", schema.GroupResource{Group: "apps", Resource: "statefulsets"}, true},
+		{"/k8s/clusters/c-1/api/v1/services", schema.GroupResource{Resource: "services"}, true},
+		{"/api/v1/namespaces/default/pods/foo-0", schema.GroupResource{}, false},
+		{"/apis/apps/v1", schema.GroupResource{}, false},
+		{"/version", schema.GroupResource{}, false},
+	}
+
+	for _, c := range cases {
+		gr, ok := collectionResource(c.path)
+		require.Equal(t, c.ok, ok, c.path)
+		require.Equal(t, c.gr, gr, c.path)
+	}
+}
+
+const (
+	fakePods    = 5000
+	labeledPods = 50
+)
+
+// fakeAPIServer serves pods, labeledPods of them carry role=etcd; list honors labelSelector, watch stays open
+func fakeAPIServer(tb testing.TB) *httptest.Server {
+	pods := &corev1.PodList{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PodList"},
+		ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+	}
+	for i := 0; i < fakePods; i++ {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            fmt.Sprintf("pod-%d", i),
+				Namespace:       "default",
+				ResourceVersion: "1",
+				Labels:          map[string]string{"app": "other"},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app:1.0"}}},
+		}
+		if i < labeledPods {
+			pod.Labels = map[string]string{"role": "etcd"}
+		}
+		pods.Items = append(pods.Items, pod)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("watch") == "true" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+
+		selector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r := &corev1.PodList{TypeMeta: pods.TypeMeta, ListMeta: pods.ListMeta}
+		for _, pod := range pods.Items {
+			if selector.Matches(labels.Set(pod.Labels)) {
+				r.Items = append(r.Items, pod)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(r)
+	}))
+}
+
+func startCache(tb testing.TB, host string, newCache crcache.NewCacheFunc) (crcache.Cache, context.CancelFunc) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Pod"), meta.RESTScopeNamespace)
+
+	c, err := newCache(&rest.Config{Host: host}, crcache.Options{Scheme: clientgoscheme.Scheme, Mapper: mapper})
+	require.NoError(tb, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = c.GetInformer(ctx, &corev1.Pod{})
+	require.NoError(tb, err)
+	go func() {
+		_ = c.Start(ctx)
+	}()
+	require.True(tb, c.WaitForCacheSync(ctx))
+
+	return c, cancel
+}
+
+func TestNew(t *testing.T) {
+	srv := fakeAPIServer(t)
+	defer srv.Close()
+
+	c, cancel := startCache(t, srv.URL, New(Selectors{{Resource: "pods"}: "role=etcd"}))
+	defer cancel()
+
+	list := &corev1.PodList{}
+	require.NoError(t, c.List(context.Background(), list))
+	require.Len(t, list.Items, labeledPods)
+
+	// selectors of a reader are still applied on top
+	list = &corev1.PodList{}
+	require.NoError(t, c.List(context.Background(), list, client.MatchingLabels{"app": "other"}))
+	require.Empty(t, list.Items)
+}
+
+// go test ./pkg/cache -run x -bench . -benchmem
+func BenchmarkCache(b *testing.B) {
+	srv := fakeAPIServer(b)
+	defer srv.Close()
+
+	bench := func(newCache crcache.NewCacheFunc) func(b *testing.B) {
+		return func(b *testing.B) {
+			var heap int64
+			for i := 0; i < b.N; i++ {
+				before := heapInUse()
+				c, cancel := startCache(b, srv.URL, newCache)
+				heap += heapInUse() - before
+
+				list := &corev1.PodList{}
+				require.NoError(b, c.List(context.Background(), list))
+				cancel()
+			}
+			b.ReportMetric(float64(heap)/float64(b.N), "cache-heap-B/op")
+		}
+	}
+
+	b.Run("all", bench(crcache.New))
+	b.Run("selected", bench(New(Selectors{{Resource: "pods"}: "role=etcd"})))
+}
+
+func heapInUse() int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapInuse)
+}
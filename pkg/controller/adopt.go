@@ -0,0 +1,269 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	errors2 "github.com/pkg/errors"
+	"github.com/win5do/go-lib/errx"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrlcli "sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+// endpointStatus output of `etcdctl endpoint status -w json`, written by the inspect job
+type endpointStatus struct {
+	Status struct {
+		Header struct {
+			ClusterID uint64 `json:"cluster_id"`
+			MemberID  uint64 `json:"member_id"`
+		} `json:"header"`
+	} `json:"Status"`
+}
+
+// SyncAdoption keeps a recreated cluster from silently starting on the PVCs
+// retained by an earlier cluster of the same name. With spec.adoptVolumes the
+// PVCs are checked to hold a single etcd cluster, then relabelled so the
+// members start on the existing data instead of bootstrapping.
+func (s *controller) SyncAdoption() error {
+	cr := s.cr
+	st := cr.Status.Adoption
+
+	if st != nil && st.Phase == dbv1.AdoptionPhaseAdopted {
+		return nil
+	}
+
+	list := &corev1.PersistentVolumeClaimList{}
+	err := s.Kcli.ListByLabel(s.ctx, cr.Namespace, orphanedPVCLabel(cr.Name), list)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	if len(list.Items) == 0 {
+		if st != nil {
+			// retained PVCs were deleted, bootstrap a new cluster
+			cr.Status.Adoption = nil
+			s.writeStatus()
+			return nil
+		}
+		return nil
+	}
+
+	if !cr.Spec.AdoptVolumes {
+		return errors2.Wrapf(rerr.Err_invalid_spec, "found %d PVCs retained by an earlier cluster named %s, set spec.adoptVolumes to start from their data or delete them",
+			len(list.Items), cr.Name)
+	}
+
+	// Failed is checked again, fixed PVCs or deleted failed inspect jobs start over
+	if st == nil || st.Phase == dbv1.AdoptionPhaseFailed {
+		previousUID, err := s.checkOrphanedPVC(list.Items)
+		if err != nil {
+			return s.failAdoption(err.Error())
+		}
+
+		if st == nil {
+			s.reqLog.Infof("adopt PVCs of earlier cluster %s", previousUID)
+			cr.Status.Adoption = &dbv1.AdoptionStatus{
+				Phase:       dbv1.AdoptionPhaseInspecting,
+				PreviousUID: previousUID,
+			}
+			// recorded before the inspect jobs are created
+			err = s.persistStatus()
+			if err != nil {
+				return errx.WithStackOnce(err)
+			}
+		} else if st.PreviousUID == "" {
+			// failed before the PVCs could be checked
+			st.PreviousUID = previousUID
+		}
+	}
+
+	clusterID, done, err := s.inspectMembers()
+	if err != nil {
+		return s.failAdoption(err.Error())
+	}
+
+	if st := cr.Status.Adoption; st.Phase == dbv1.AdoptionPhaseFailed {
+		s.reqLog.Infof("inspect jobs retried, resume adoption")
+		st.Phase = dbv1.AdoptionPhaseInspecting
+		st.Reason = ""
+		s.writeStatus()
+	}
+
+	if !done {
+		s.reqLog.Debug("wait inspect jobs")
+		return errors2.WithStack(rerr.Err_wait_requeue)
+	}
+
+	for i := range list.Items {
+		pvc := &list.Items[i]
+		err := s.Kcli.MergePatchObject(s.ctx, pvc, map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]interface{}{
+					LabelCrUID: string(cr.UID),
+					Orphaned:   nil,
+				},
+			},
+		})
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+		s.reqLog.Infof("adopted PVC %s", pvc.Name)
+	}
+
+	err = s.Kcli.DeleteALLByLabel(s.ctx, &batchv1.Job{}, cr.Namespace, jobLabel(cr.ObjectMeta, inspect),
+		ctrlcli.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	cr.Status.Adoption.Phase = dbv1.AdoptionPhaseAdopted
+	cr.Status.Adoption.ClusterID = clusterID
+	s.writeStatus()
+	return nil
+}
+
+func (s *controller) failAdoption(reason string) error {
+	s.reqLog.Warnf("adopt volumes failed: %s", reason)
+
+	if s.cr.Status.Adoption == nil {
+		s.cr.Status.Adoption = &dbv1.AdoptionStatus{}
+	}
+	s.cr.Status.Adoption.Phase = dbv1.AdoptionPhaseFailed
+	s.cr.Status.Adoption.Reason = reason
+	s.writeStatus()
+
+	return errors2.Wrapf(rerr.Err_invalid_spec, "adopt volumes failed: %s", reason)
+}
+
+// checkOrphanedPVC the PVCs must come from one cluster and match the claims of the new StatefulSet
+func (s *controller) checkOrphanedPVC(items []corev1.PersistentVolumeClaim) (string, error) {
+	cr := s.cr
+
+	uids := map[string]bool{}
+	found := map[string]bool{}
+	for _, v := range items {
+		uids[v.Labels[LabelCrUID]] = true
+		found[v.Name] = true
+	}
+
+	if len(uids) != 1 {
+		return "", errors2.Errorf("PVCs come from %d different clusters", len(uids))
+	}
+
+	var missing []string
+	sts := s.Builder.StatefulSet(MemberLabel(cr.ObjectMeta, SelectAll))
+	for _, claim := range sts.Spec.VolumeClaimTemplates {
+		for i := 0; i < cr.Spec.Members; i++ {
+			name := AddSuffix(claim.Name, podName(cr.Name, i))
+			if !found[name] {
+				missing = append(missing, name)
+			}
+			delete(found, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return "", errors2.Errorf("missing PVCs: %s", strings.Join(missing, ","))
+	}
+
+	if len(found) > 0 {
+		var extra []string
+		for k := range found {
+			extra = append(extra, k)
+		}
+		sort.Strings(extra)
+		return "", errors2.Errorf("PVCs not used by %d members: %s", cr.Spec.Members, strings.Join(extra, ","))
+	}
+
+	for k := range uids {
+		return k, nil
+	}
+	return "", nil
+}
+
+// inspectMembers runs an inspect job per member and checks they report the same cluster ID
+func (s *controller) inspectMembers() (string, bool, error) {
+	cr := s.cr
+
+	done := true
+	var clusterID uint64
+	for i := 0; i < cr.Spec.Members; i++ {
+		name := AddSuffix(cr.Name, inspect, strconv.Itoa(i))
+
+		found := &batchv1.Job{}
+		err := s.Kcli.Ensure(s.ctx, s.Builder.InspectJob(name, i), found)
+		if err != nil {
+			return "", false, errx.WithStackOnce(err)
+		}
+
+		if found.Status.Failed > 0 {
+			return "", false, errors2.Errorf("inspect member %d failed, see job %s and delete it to retry", i, name)
+		}
+
+		if found.Status.Succeeded == 0 {
+			done = false
+			continue
+		}
+
+		id, err := s.inspectResult(name)
+		if err != nil {
+			return "", false, errx.WithStackOnce(err)
+		}
+
+		if id == 0 {
+			return "", false, errors2.Errorf("member %d has no cluster ID", i)
+		}
+
+		if clusterID != 0 && id != clusterID {
+			return "", false, errors2.Errorf("member %d belongs to cluster %x, others to %x", i, id, clusterID)
+		}
+		clusterID = id
+	}
+
+	if !done {
+		return "", false, nil
+	}
+
+	return fmt.Sprintf("%x", clusterID), true, nil
+}
+
+func (s *controller) inspectResult(jobName string) (uint64, error) {
+	pods := &corev1.PodList{}
+	err := s.Kcli.ListByLabel(s.ctx, s.cr.Namespace, map[string]string{"job-name": jobName}, pods)
+	if err != nil {
+		return 0, errx.WithStackOnce(err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+
+		for _, c := range pod.Status.ContainerStatuses {
+			if c.State.Terminated == nil {
+				continue
+			}
+
+			var r []endpointStatus
+			err := json.Unmarshal([]byte(c.State.Terminated.Message), &r)
+			if err != nil {
+				return 0, errors2.Wrapf(err, "parse result of %s", jobName)
+			}
+			if len(r) == 0 {
+				return 0, errors2.Errorf("empty result of %s", jobName)
+			}
+
+			return r[0].Status.Header.ClusterID, nil
+		}
+	}
+
+	return 0, errors2.Errorf("no result of %s", jobName)
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+func TestCheckOrphanedPVC(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			UID:       "uid-2",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+			Storage: "1Gi",
+		},
+	}
+	ct := &controller{
+		cr:      cr,
+		Builder: NewResourceBuilder(cr),
+	}
+
+	pvc := func(name, uid string) corev1.PersistentVolumeClaim {
+		return corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{LabelCrUID: uid},
+			},
+		}
+	}
+
+	items := []corev1.PersistentVolumeClaim{
+		pvc("data-foo-0", "uid-1"),
+		pvc("data-foo-1", "uid-1"),
+		pvc("data-foo-2", "uid-1"),
+	}
+	uid, err := ct.checkOrphanedPVC(items)
+	require.NoError(t, err)
+	require.Equal(t, "uid-1", uid)
+
+	_, err = ct.checkOrphanedPVC(items[:2])
+	require.Error(t, err, "missing member")
+
+	_, err = ct.checkOrphanedPVC(append(items, pvc("data-foo-3", "uid-1")))
+	require.Error(t, err, "extra member")
+
+	_, err = ct.checkOrphanedPVC(append(items[:2:2], pvc("data-foo-2", "uid-0")))
+	require.Error(t, err, "two clusters")
+}
+
+func TestEndpointStatus(t *testing.T) {
+	out := `[{"Endpoint":"127.0.0.1:2379","Status":{"header":{"cluster_id":14841639068965178418,"member_id":10276657743932975437,"revision":1,"raft_term":2},"version":"3.4.15","dbSize":20480,"leader":10276657743932975437}}]`
+
+	var r []endpointStatus
+	require.NoError(t, json.Unmarshal([]byte(out), &r))
+	require.Equal(t, uint64(14841639068965178418), r[0].Status.Header.ClusterID)
+}
+
+func TestAdoptionRetry(t *testing.T) {
+	cr := testEtcd(1)
+	cr.Spec.Storage = "1Gi"
+	cr.Spec.AdoptVolumes = true
+	cr.Status.Adoption = &dbv1.AdoptionStatus{Phase: dbv1.AdoptionPhaseFailed, Reason: "inspect member 0 failed"}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "data-foo-0",
+			Namespace: "default",
+			Labels:    MergeLabels(orphanedPVCLabel("foo"), map[string]string{LabelCrUID: "uid-1"}),
+		},
+	}
+	ct, cli := newFakeController(t, cr, pvc)
+
+	// the failed job was deleted, a new one runs
+	err := ct.SyncAdoption()
+	require.True(t, errors.Is(err, rerr.Err_wait_requeue), "%+v", err)
+	require.Equal(t, dbv1.AdoptionPhaseInspecting, cr.Status.Adoption.Phase)
+	require.Empty(t, cr.Status.Adoption.Reason)
+	require.Equal(t, "uid-1", cr.Status.Adoption.PreviousUID)
+
+	// fails again
+	ctx := context.Background()
+	job := &batchv1.Job{}
+	require.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: "foo-inspect-0"}, job))
+	job.Status.Failed = 1
+	require.NoError(t, cli.Status().Update(ctx, job))
+
+	err = ct.SyncAdoption()
+	require.True(t, errors.Is(err, rerr.Err_invalid_spec), "%+v", err)
+	require.Equal(t, dbv1.AdoptionPhaseFailed, cr.Status.Adoption.Phase)
+
+	// the data is only read from a copy
+	for _, m := range ct.Builder.InspectJob("foo-inspect-0", 0).Spec.Template.Spec.Containers[0].VolumeMounts {
+		if m.Name == dataVolumeName {
+			require.True(t, m.ReadOnly)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/win5do/go-lib/errx"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+const (
+	prometheusRuleKind = "PrometheusRule"
+	alertsComponent    = "alerts"
+
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+var defaultAlerts = dbv1.AlertsSpec{
+	LeaderChangesPerHour:      4,
+	FsyncLatencyMilliseconds:  500,
+	CommitLatencyMilliseconds: 250,
+	DBSizePercent:             80,
+	FailedProposalsPerHour:    5,
+}
+
+// SyncAlerts creates the PrometheusRule of spec.monitoring.alerts, it is removed when unset
+func (s *controller) SyncAlerts() error {
+	cr := s.cr
+
+	if alertsSpec(cr) == nil {
+		if !cr.Status.PrometheusRule {
+			return nil
+		}
+
+		s.reqLog.Info("alerts unset, delete prometheusRule")
+		err := s.deleteUnstructured(s.Builder.PrometheusRule(cr.Name))
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+
+		cr.Status.PrometheusRule = false
+		s.writeStatus()
+		return nil
+	}
+
+	ok, err := s.syncUnstructured(s.Builder.PrometheusRule(cr.Name))
+	if err != nil || !ok {
+		return err
+	}
+
+	if !cr.Status.PrometheusRule {
+		cr.Status.PrometheusRule = true
+		s.writeStatus()
+	}
+
+	return nil
+}
+
+func alertsSpec(cr *dbv1.Etcd) *dbv1.AlertsSpec {
+	if cr.Spec.Monitoring == nil {
+		return nil
+	}
+
+	return cr.Spec.Monitoring.Alerts
+}
+
+type alertRule struct {
+	Name        string
+	Expr        string
+	For         string
+	Severity    string
+	Description string
+}
+
+// PrometheusRule the etcd-mixin alerts, scoped to the members by namespace and pod
+func (s *ResourceBuilder) PrometheusRule(name string) *unstructured.Unstructured {
+	cr := s.cr
+
+	t := defaultAlerts
+	var extra map[string]string
+	if m := cr.Spec.Monitoring; m != nil {
+		extra = m.Labels
+		if m.Alerts != nil {
+			t = alertThresholds(*m.Alerts)
+		}
+	}
+
+	var rules []interface{}
+	for _, r := range s.alertRules(t) {
+		rules = append(rules, map[string]interface{}{
+			"alert": r.Name,
+			"expr":  r.Expr,
+			"for":   r.For,
+			"labels": map[string]interface{}{
+				"severity":     r.Severity,
+				"etcd_cluster": cr.Name,
+			},
+			"annotations": map[string]interface{}{
+				"summary":     fmt.Sprintf("etcd cluster %s/%s: %s", cr.Namespace, cr.Name, r.Name),
+				"description": r.Description,
+			},
+		})
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(monitoringGV.WithKind(prometheusRuleKind))
+	obj.SetName(name)
+	obj.SetNamespace(cr.Namespace)
+	obj.Object["spec"] = map[string]interface{}{
+		"groups": []interface{}{
+			map[string]interface{}{
+				"name":  fmt.Sprintf("etcd-%s-%s", cr.Namespace, cr.Name),
+				"rules": rules,
+			},
+		},
+	}
+
+	return s.finishUnstructured(obj, extra, alertsComponent)
+}
+
+func (s *ResourceBuilder) alertRules(t dbv1.AlertsSpec) []alertRule {
+	cr := s.cr
+
+	// pod is set on targets of both ServiceMonitor and PodMonitor
+	sel := fmt.Sprintf(`namespace="%s",pod=~"%s-[0-9]+"`, cr.Namespace, cr.Name)
+
+	return []alertRule{
+		{
+			Name:        "EtcdMembersDown",
+			Expr:        fmt.Sprintf(`(sum(up{%s}) or vector(0)) < %d`, sel, cr.Spec.Members),
+			For:         "3m",
+			Severity:    severityCritical,
+			Description: fmt.Sprintf("fewer than %d members are up", cr.Spec.Members),
+		},
+		{
+			Name:        "EtcdNoLeader",
+			Expr:        fmt.Sprintf(`etcd_server_has_leader{%s} == 0`, sel),
+			For:         "1m",
+			Severity:    severityCritical,
+			Description: "member {{ $labels.pod }} has no leader",
+		},
+		{
+			Name:        "EtcdHighNumberOfLeaderChanges",
+			Expr:        fmt.Sprintf(`increase(etcd_server_leader_changes_seen_total{%s}[1h]) > %d`, sel, t.LeaderChangesPerHour),
+			For:         "5m",
+			Severity:    severityWarning,
+			Description: "member {{ $labels.pod }} saw {{ $value }} leader changes within the last hour",
+		},
+		{
+			Name: "EtcdHighFsyncDurations",
+			Expr: fmt.Sprintf(`histogram_quantile(0.99, sum by (pod, le) (rate(etcd_disk_wal_fsync_duration_seconds_bucket{%s}[5m]))) > %s`,
+				sel, seconds(t.FsyncLatencyMilliseconds)),
+			For:         "10m",
+			Severity:    severityWarning,
+			Description: "99th percentile WAL fsync of member {{ $labels.pod }} is {{ $value }}s",
+		},
+		{
+			Name: "EtcdHighCommitDurations",
+			Expr: fmt.Sprintf(`histogram_quantile(0.99, sum by (pod, le) (rate(etcd_disk_backend_commit_duration_seconds_bucket{%s}[5m]))) > %s`,
+				sel, seconds(t.CommitLatencyMilliseconds)),
+			For:         "10m",
+			Severity:    severityWarning,
+			Description: "99th percentile backend commit of member {{ $labels.pod }} is {{ $value }}s",
+		},
+		{
+			Name: "EtcdDatabaseQuotaLowSpace",
+			Expr: fmt.Sprintf(`etcd_mvcc_db_total_size_in_bytes{%s} / etcd_server_quota_backend_bytes{%s} * 100 > %d`,
+				sel, sel, t.DBSizePercent),
+			For:         "10m",
+			Severity:    severityCritical,
+			Description: "db of member {{ $labels.pod }} uses {{ $value }}% of the backend quota",
+		},
+		{
+			Name:        "EtcdHighNumberOfFailedProposals",
+			Expr:        fmt.Sprintf(`increase(etcd_server_proposals_failed_total{%s}[1h]) > %d`, sel, t.FailedProposalsPerHour),
+			For:         "15m",
+			Severity:    severityWarning,
+			Description: "member {{ $labels.pod }} failed {{ $value }} proposals within the last hour",
+		},
+	}
+}
+
+// alertThresholds fields left zero take the default
+func alertThresholds(in dbv1.AlertsSpec) dbv1.AlertsSpec {
+	pick := func(v, d int32) int32 {
+		if v > 0 {
+			return v
+		}
+		return d
+	}
+
+	d := defaultAlerts
+	return dbv1.AlertsSpec{
+		LeaderChangesPerHour:      pick(in.LeaderChangesPerHour, d.LeaderChangesPerHour),
+		FsyncLatencyMilliseconds:  pick(in.FsyncLatencyMilliseconds, d.FsyncLatencyMilliseconds),
+		CommitLatencyMilliseconds: pick(in.CommitLatencyMilliseconds, d.CommitLatencyMilliseconds),
+		DBSizePercent:             pick(in.DBSizePercent, d.DBSizePercent),
+		FailedProposalsPerHour:    pick(in.FailedProposalsPerHour, d.FailedProposalsPerHour),
+	}
+}
+
+func seconds(ms int32) string {
+	return fmt.Sprintf("%g", float64(ms)/1000)
+}
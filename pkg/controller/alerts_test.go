@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestPrometheusRule(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+			Monitoring: &dbv1.MonitoringSpec{
+				Labels: map[string]string{"release": "prometheus"},
+				Alerts: &dbv1.AlertsSpec{FsyncLatencyMilliseconds: 1000},
+			},
+		},
+	}
+
+	obj := NewResourceBuilder(cr).PrometheusRule(cr.Name)
+	require.Equal(t, "PrometheusRule", obj.GetKind())
+	require.Equal(t, "prometheus", obj.GetLabels()["release"])
+	require.NotPanics(t, func() { obj.DeepCopy() })
+
+	groups, _, _ := unstructured.NestedSlice(obj.Object, "spec", "groups")
+	require.Len(t, groups, 1)
+	rules := groups[0].(map[string]interface{})["rules"].([]interface{})
+	require.Len(t, rules, 7)
+
+	exprs := map[string]string{}
+	for _, r := range rules {
+		r := r.(map[string]interface{})
+		exprs[r["alert"].(string)] = r["expr"].(string)
+	}
+	require.Contains(t, exprs["EtcdHighFsyncDurations"], `namespace="default",pod=~"foo-[0-9]+"`)
+	require.Contains(t, exprs["EtcdHighFsyncDurations"], "> 1")
+	require.Contains(t, exprs["EtcdHighCommitDurations"], "> 0.25")
+	require.Contains(t, exprs["EtcdMembersDown"], "< 3")
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"crypto/x509"
+	"strings"
+
+	"github.com/win5do/go-lib/errx"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// file names kubeadm uses under /etc/kubernetes/pki for an external etcd
+const (
+	apiserverEtcdCA         = "etcd-ca.crt"
+	apiserverEtcdClientCert = "apiserver-etcd-client.crt"
+	apiserverEtcdClientKey  = "apiserver-etcd-client.key"
+
+	// EtcdServersKey value for kube-apiserver --etcd-servers
+	EtcdServersKey = "etcd-servers"
+)
+
+// SyncKubeApiserverClient issues the client cert of a kube-apiserver using the cluster as storage.
+// With auth enabled etcd takes the cert CN as the user, so it is granted the root role.
+func (s *controller) SyncKubeApiserverClient() error {
+	cr := s.cr
+
+	spec := cr.Spec.KubeApiserverClient
+	if spec == nil || !cr.TLSEnabled() {
+		return nil
+	}
+
+	ca, err := s.ensureCA()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	err = s.ensureCert(ca, certSecret{
+		Name:    cr.KubeApiserverClientSecretName(),
+		Type:    corev1.SecretTypeOpaque,
+		CAKey:   apiserverEtcdCA,
+		CertKey: apiserverEtcdClientCert,
+		KeyKey:  apiserverEtcdClientKey,
+		Extra: map[string][]byte{
+			EtcdServersKey: []byte(strings.Join(memberEndpoints(cr), ",")),
+		},
+	}, spec.CommonName, nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	if !cr.Status.AuthEnabled || cr.Status.KubeApiserverUser == spec.CommonName {
+		return nil
+	}
+
+	cli, err := s.etcdClient()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	defer cli.Close()
+
+	s.reqLog.Infof("grant root role to %s", spec.CommonName)
+	err = cli.GrantCertUser(s.ctx, spec.CommonName)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	cr.Status.KubeApiserverUser = spec.CommonName
+	s.writeStatus()
+	return nil
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"github.com/win5do/go-lib/errx"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+
+	"github.com/win5do/etcd-operator/pkg/etcdcli"
+)
+
+const (
+	rootUser       = "root"
+	passwordLength = 24
+
+	// appUser published in the connection Secret, appRole grants it the keys but nothing of root
+	appUser = "app"
+	appRole = "app"
+)
+
+// SyncAuth turns etcd authentication on or off to match spec.auth.
+// The root password is generated once and kept in the auth Secret, the operator alone uses it.
+// Applications get the app user of the app auth Secret.
+func (s *controller) SyncAuth() error {
+	cr := s.cr
+
+	if cr.AuthEnabled() {
+		err := s.ensureAuthSecret(cr.AuthSecretName(), rootUser)
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+
+		err = s.ensureAuthSecret(cr.AppAuthSecretName(), appUser)
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+	}
+
+	if cr.AuthEnabled() != cr.Status.AuthEnabled {
+		err := s.switchAuth()
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+	}
+
+	return s.ensureAppUser()
+}
+
+func (s *controller) ensureAuthSecret(name, user string) error {
+	cr := s.cr
+
+	meta := s.Builder.secretMetadata(name, baseLabel(cr.ObjectMeta), authSecret)
+	found := &corev1.Secret{}
+	err := s.Kcli.Ensure(s.ctx, &corev1.Secret{
+		ObjectMeta: meta,
+		Type:       corev1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte(user),
+			corev1.BasicAuthPasswordKey: []byte(rand.String(passwordLength)),
+		},
+	}, found)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	// found is only filled when the Secret already existed
+	if found.Name != "" {
+		return s.syncMetadata(found, meta)
+	}
+
+	return nil
+}
+
+// switchAuth auth is switched through the cluster
+func (s *controller) switchAuth() error {
+	cr := s.cr
+
+	// wait until every member is up
+	sts := &appsv1.StatefulSet{}
+	err := s.Kcli.Find(s.ctx, cr.Name, cr.Namespace, sts)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	if sts.Status.ReadyReplicas < int32(cr.Spec.Members) {
+		s.reqLog.Debug("wait members ready before switching auth")
+		return nil
+	}
+
+	cli, err := s.etcdClient()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	defer cli.Close()
+
+	if cr.AuthEnabled() {
+		password, err := s.rootPassword()
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+
+		s.reqLog.Info("enable auth")
+		err = cli.EnableAuth(s.ctx, rootUser, password)
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+	} else {
+		s.reqLog.Info("disable auth")
+		err = cli.DisableAuth(s.ctx)
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+	}
+
+	cr.Status.AuthEnabled = cr.AuthEnabled()
+	s.writeStatus()
+	return nil
+}
+
+// ensureAppUser once auth is enabled, before that etcd checks no permissions and any client may connect
+func (s *controller) ensureAppUser() error {
+	cr := s.cr
+
+	if !cr.Status.AuthEnabled || cr.Status.AppUser == appUser {
+		return nil
+	}
+
+	password, err := s.password(cr.AppAuthSecretName())
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	cli, err := s.etcdClient()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	defer cli.Close()
+
+	s.reqLog.Infof("create user %s", appUser)
+	err = cli.EnsureAppUser(s.ctx, appUser, password, appRole)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	cr.Status.AppUser = appUser
+	s.writeStatus()
+	return nil
+}
+
+func (s *controller) rootPassword() (string, error) {
+	return s.password(s.cr.AuthSecretName())
+}
+
+func (s *controller) password(secret string) (string, error) {
+	found := &corev1.Secret{}
+	err := s.Kcli.Find(s.ctx, secret, s.cr.Namespace, found)
+	if err != nil {
+		return "", errx.WithStackOnce(err)
+	}
+
+	return string(found.Data[corev1.BasicAuthPasswordKey]), nil
+}
+
+// etcdClient connects to every member with the TLS and credentials the cluster currently requires
+func (s *controller) etcdClient() (*etcdcli.Client, error) {
+	cr := s.cr
+
+	cfg := etcdcli.Config{
+		Endpoints: memberEndpoints(cr),
+	}
+
+	if cr.TLSEnabled() {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+		cfg.TLS = tlsConfig
+	}
+
+	// credentials are rejected until auth is enabled on the cluster
+	if cr.Status.AuthEnabled {
+		password, err := s.rootPassword()
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+		cfg.Username = rootUser
+		cfg.Password = password
+	}
+
+	return etcdcli.New(s.ctx, cfg)
+}
@@ -1,9 +1,19 @@
 package controller
 
 import (
+	"fmt"
+
+	errors2 "github.com/pkg/errors"
 	"github.com/win5do/go-lib/errx"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
 )
 
 const etcdFinalizer = "etcd-operator/finalizer"
@@ -13,6 +23,7 @@ func (s *controller) Finalize() error {
 		// Run finalization logic for memcachedFinalizer. If the
 		// finalization logic fails, don't remove the finalizer so
 		// that we can retry during the next reconciliation.
+		s.Kcli.Event(corev1.EventTypeNormal, ReasonFinalizing, "cleanup with deletionPolicy %q", s.cr.Spec.DeletionPolicy)
 		err := s.cleanup()
 		if err != nil {
 			return errx.WithStackOnce(err)
@@ -24,19 +35,140 @@ func (s *controller) Finalize() error {
 		}
 
 		s.reqLog.Info("success finalized")
+		s.Kcli.Event(corev1.EventTypeNormal, ReasonFinalized, "finalizer removed")
 	}
 
 	return nil
 }
 
 func (s *controller) cleanup() error {
-	// clean PVC
-	err := s.Kcli.DeleteALLByLabel(&corev1.PersistentVolumeClaim{}, s.cr.Namespace,
-		MemberLabel(s.cr.ObjectMeta, SelectAll))
+	cr := s.cr
+
+	switch cr.Spec.DeletionPolicy {
+	case dbv1.DeletionPolicyRetain:
+		return s.orphanPVC()
+	case dbv1.DeletionPolicySnapshot:
+		err := s.finalSnapshot()
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+	}
+
+	// clean PVC, data and wal claims both carry the member label
+	list := &corev1.PersistentVolumeClaimList{}
+	err := s.Kcli.ListByLabel(s.ctx, cr.Namespace, MemberLabel(cr.ObjectMeta, SelectAll), list)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	for i := range list.Items {
+		pvc := &list.Items[i]
+		// the snapshots outlive the cluster unless it is deleted with them
+		if pvc.Name == snapshotClaimName(cr) && cr.Spec.DeletionPolicy != dbv1.DeletionPolicyDelete {
+			continue
+		}
+
+		err := s.Kcli.DeleteObject(s.ctx, pvc)
+		if err != nil && !k8serr.IsNotFound(err) {
+			return errx.WithStackOnce(err)
+		}
+	}
+
+	return nil
+}
+
+// finalSnapshot blocks the finalizer until the final snapshot is safe,
+// unless the user gives it up with the skip annotation
+func (s *controller) finalSnapshot() error {
+	cr := s.cr
+
+	if cr.Annotations[dbv1.AnnotationSkipFinalSnapshot] == "true" {
+		s.Kcli.Event(corev1.EventTypeWarning, ReasonSnapshotSkip, "final snapshot skipped by annotation %s", dbv1.AnnotationSkipFinalSnapshot)
+		return s.deleteSnapshotJobs(snapshotFinal)
+	}
+
+	done, err := s.EnsureSnapshot(AddSuffix(cr.Name, snapshotFinal), snapshotFinal, cr.Spec.DeletionSnapshot)
+	if err != nil {
+		s.Kcli.Event(corev1.EventTypeWarning, ReasonSnapshotFail, "%v, delete the job to retry or set annotation %s=true to delete without it",
+			err, dbv1.AnnotationSkipFinalSnapshot)
+		return errx.WithStackOnce(err)
+	}
+	if !done {
+		err := s.checkMembersForSnapshot()
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+
+		s.reqLog.Debug("wait final snapshot")
+		return errors2.WithStack(rerr.Err_wait_requeue)
+	}
+
+	// the job is not owned by the cluster, GC won't remove it
+	return s.deleteSnapshotJobs(snapshotFinal)
+}
+
+// checkMembersForSnapshot the snapshot is read from the members, it can not be taken once they are removed,
+// e.g. by a foreground cascading delete. The PVCs are kept, the deletion waits for the skip annotation
+func (s *controller) checkMembersForSnapshot() error {
+	cr := s.cr
+
+	sts := &appsv1.StatefulSet{}
+	err := s.Kcli.Find(s.ctx, cr.Name, cr.Namespace, sts)
+	if err != nil && !k8serr.IsNotFound(err) {
+		return errx.WithStackOnce(err)
+	}
+	if err == nil && sts.DeletionTimestamp == nil {
+		return nil
+	}
+
+	msg := "members removed before the final snapshot"
+	if contains(cr.Finalizers, metav1.FinalizerDeleteDependents) {
+		msg += " by a foreground delete"
+	}
+	msg = fmt.Sprintf("%s, the PVCs are kept, set annotation %s=true to finish the deletion without it",
+		msg, dbv1.AnnotationSkipFinalSnapshot)
+
+	if !meta.IsStatusConditionTrue(cr.Status.Conditions, dbv1.ConditionFinalSnapshotBlocked) {
+		s.Kcli.Event(corev1.EventTypeWarning, ReasonSnapshotFail, "%s", msg)
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, metav1.Condition{
+		Type:               dbv1.ConditionFinalSnapshotBlocked,
+		Status:             metav1.ConditionTrue,
+		Reason:             dbv1.ReasonMembersRemoved,
+		Message:            msg,
+		ObservedGeneration: cr.Generation,
+	})
+	s.writeStatus()
+
+	return errors2.WithStack(rerr.Err_wait_requeue)
+}
+
+// orphanPVC keeps the PVCs of a deleted cluster and marks them for later adoption
+func (s *controller) orphanPVC() error {
+	list := &corev1.PersistentVolumeClaimList{}
+	err := s.Kcli.ListByLabel(s.ctx, s.cr.Namespace, MemberLabel(s.cr.ObjectMeta, SelectAll), list)
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
 
+	for i := range list.Items {
+		pvc := &list.Items[i]
+		// only member data is adopted
+		if pvc.Labels[Orphaned] == "true" || pvc.Name == snapshotClaimName(s.cr) {
+			continue
+		}
+
+		err := s.Kcli.PatchObject(s.ctx, pvc, &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: orphanedLabel(),
+			},
+		})
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+		s.reqLog.Infof("retain PVC %s", pvc.Name)
+	}
+
 	return nil
 }
 
@@ -44,8 +176,10 @@ func (s *controller) AddFinalizer() error {
 	cr := s.cr
 
 	if !contains(cr.GetFinalizers(), etcdFinalizer) {
-		controllerutil.AddFinalizer(cr, etcdFinalizer)
-		err := s.Kcli.UpdateObject(cr)
+		err := s.Kcli.UpdateObject(s.ctx, cr, func() error {
+			controllerutil.AddFinalizer(cr, etcdFinalizer)
+			return nil
+		})
 		if err != nil {
 			return errx.WithStackOnce(err)
 		}
@@ -59,8 +193,10 @@ func (s *controller) removeFinalizer() error {
 
 	// Remove memcachedFinalizer. Once all finalizers have been
 	// removed, the object will be deleted.
-	controllerutil.RemoveFinalizer(cr, etcdFinalizer)
-	err := s.Kcli.UpdateObject(cr)
+	err := s.Kcli.UpdateObject(s.ctx, cr, func() error {
+		controllerutil.RemoveFinalizer(cr, etcdFinalizer)
+		return nil
+	})
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
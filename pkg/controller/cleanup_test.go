@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+func TestFinalSnapshot(t *testing.T) {
+	ctx := context.Background()
+	jobKey := client.ObjectKey{Namespace: "default", Name: "foo-" + snapshotFinal}
+
+	newCr := func() *dbv1.Etcd {
+		cr := testEtcd(1)
+		cr.UID = "uid-1"
+		cr.Spec.DeletionPolicy = dbv1.DeletionPolicySnapshot
+		cr.Spec.DeletionSnapshot = &dbv1.SnapshotDestination{PVC: &dbv1.PVCDestination{ClaimName: "backup"}}
+		return cr
+	}
+
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+
+	t.Run("job not owned by the cluster", func(t *testing.T) {
+		cr := newCr()
+		ct, cli := newFakeController(t, cr, sts.DeepCopy())
+		err := ct.cleanup()
+		require.True(t, errors.Is(err, rerr.Err_wait_requeue), "%+v", err)
+		require.Nil(t, meta.FindStatusCondition(cr.Status.Conditions, dbv1.ConditionFinalSnapshotBlocked))
+
+		job := &batchv1.Job{}
+		require.NoError(t, cli.Get(ctx, jobKey, job))
+		require.Empty(t, job.OwnerReferences)
+	})
+
+	t.Run("members removed by a foreground delete", func(t *testing.T) {
+		cr := newCr()
+		cr.Finalizers = []string{etcdFinalizer, metav1.FinalizerDeleteDependents}
+		pvc := memberPVC(cr, "data-foo-0")
+		ct, cli := newFakeController(t, cr, pvc)
+
+		err := ct.cleanup()
+		require.True(t, errors.Is(err, rerr.Err_wait_requeue), "%+v", err)
+		cond := meta.FindStatusCondition(cr.Status.Conditions, dbv1.ConditionFinalSnapshotBlocked)
+		require.NotNil(t, cond)
+		require.Equal(t, metav1.ConditionTrue, cond.Status)
+		require.Contains(t, cond.Message, "foreground")
+
+		// nothing is lost while blocked
+		require.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(pvc), &corev1.PersistentVolumeClaim{}))
+	})
+
+	failedJob := func(cr *dbv1.Etcd) *batchv1.Job {
+		job := NewResourceBuilder(cr).SnapshotJob(jobKey.Name, jobKey.Name+".db", cr.Spec.DeletionSnapshot)
+		job.Labels = MergeLabels(job.Labels, map[string]string{labelSnapshotFor: snapshotFinal})
+		job.UID = "job-uid"
+		job.Status.Failed = *job.Spec.BackoffLimit + 1
+		return job
+	}
+
+	t.Run("failed job blocks", func(t *testing.T) {
+		cr := newCr()
+		ct, _ := newFakeController(t, cr, failedJob(cr))
+		require.Error(t, ct.cleanup())
+	})
+
+	t.Run("skip annotation", func(t *testing.T) {
+		cr := newCr()
+		cr.Annotations = map[string]string{dbv1.AnnotationSkipFinalSnapshot: "true"}
+		pvc := memberPVC(cr, "data-foo-0")
+		snapshots := memberPVC(cr, "foo-snapshot")
+		ct, cli := newFakeController(t, cr, failedJob(cr), pvc, snapshots)
+		require.NoError(t, ct.cleanup())
+
+		require.True(t, k8serr.IsNotFound(cli.Get(ctx, jobKey, &batchv1.Job{})))
+		require.True(t, k8serr.IsNotFound(cli.Get(ctx, client.ObjectKeyFromObject(pvc), &corev1.PersistentVolumeClaim{})))
+		require.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(snapshots), &corev1.PersistentVolumeClaim{}))
+	})
+}
+
+func memberPVC(cr *dbv1.Etcd, name string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    MemberLabel(cr.ObjectMeta, SelectAll),
+		},
+	}
+}
+
+func TestSnapshotClaim(t *testing.T) {
+	ctx := context.Background()
+
+	cr := testEtcd(1)
+	cr.UID = "uid-1"
+	cr.Spec.Storage = "1Gi"
+	ct, cli := newFakeController(t, cr)
+
+	// not owned, GC would delete the snapshots with the cluster
+	dest, err := ct.defaultSnapshotDestination()
+	require.NoError(t, err)
+	pvc := &corev1.PersistentVolumeClaim{}
+	require.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: dest.PVC.ClaimName}, pvc))
+	require.Empty(t, pvc.OwnerReferences)
+
+	// owned by earlier versions
+	require.NoError(t, controllerutil.SetControllerReference(cr, pvc, cli.Scheme()))
+	require.NoError(t, cli.Update(ctx, pvc))
+	_, err = ct.defaultSnapshotDestination()
+	require.NoError(t, err)
+	pvc = &corev1.PersistentVolumeClaim{}
+	require.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: dest.PVC.ClaimName}, pvc))
+	require.Empty(t, pvc.OwnerReferences)
+
+	// Retain marks only the member data for adoption
+	data := memberPVC(cr, "data-foo-0")
+	require.NoError(t, cli.Create(ctx, data))
+	require.NoError(t, ct.orphanPVC())
+	require.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(data), data))
+	require.Equal(t, "true", data.Labels[Orphaned])
+	require.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(pvc), pvc))
+	require.Empty(t, pvc.Labels[Orphaned])
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/win5do/go-lib/logx"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/k8s"
+	"github.com/win5do/etcd-operator/pkg/metrics"
+)
+
+var (
+	clustersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "clusters"),
+		"Etcd clusters by status.",
+		[]string{"status"}, nil,
+	)
+	membersDesiredDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "cluster", "members_desired"),
+		"Members in spec of the cluster.",
+		[]string{"namespace", "name"}, nil,
+	)
+	membersReadyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "cluster", "members_ready"),
+		"Ready members of the cluster.",
+		[]string{"namespace", "name"}, nil,
+	)
+	snapshotAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "cluster", "last_snapshot_age_seconds"),
+		"Seconds since the last successful snapshot of the cluster completed.",
+		[]string{"namespace", "name"}, nil,
+	)
+	certExpiryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "certificate_expiry_timestamp_seconds"),
+		"Expiry of the certs the operator issued, one per Secret key.",
+		[]string{"namespace", "name", "secret", "key"}, nil,
+	)
+)
+
+// ClusterCollector reports the managed clusters at scrape time, read from the manager cache
+// so series of deleted clusters go away with them
+type ClusterCollector struct {
+	Reader client.Reader
+}
+
+var _ prometheus.Collector = &ClusterCollector{}
+
+func (s *ClusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clustersDesc
+	ch <- membersDesiredDesc
+	ch <- membersReadyDesc
+	ch <- snapshotAgeDesc
+	ch <- certExpiryDesc
+}
+
+func (s *ClusterCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), k8s.CtxTimeout)
+	defer cancel()
+
+	crs := &dbv1.EtcdList{}
+	err := s.Reader.List(ctx, crs)
+	if err != nil {
+		log.Warnf("collect etcd clusters: %+v", err)
+		return
+	}
+
+	byStatus := map[dbv1.NodeStatus]int{
+		dbv1.StatusReady:        0,
+		dbv1.StatusPartialReady: 0,
+		dbv1.StatusFailed:       0,
+		dbv1.StatusUnknown:      0,
+	}
+	for _, cr := range crs.Items {
+		// not reconciled yet
+		if cr.Status.Status == "" {
+			continue
+		}
+		byStatus[cr.Status.Status]++
+	}
+	for status, n := range byStatus {
+		ch <- prometheus.MustNewConstMetric(clustersDesc, prometheus.GaugeValue, float64(n), string(status))
+	}
+
+	ready := s.readyMembers(ctx)
+	for _, cr := range crs.Items {
+		key := cr.Namespace + "/" + cr.Name
+		ch <- prometheus.MustNewConstMetric(membersDesiredDesc, prometheus.GaugeValue, float64(cr.Spec.Members), cr.Namespace, cr.Name)
+		ch <- prometheus.MustNewConstMetric(membersReadyDesc, prometheus.GaugeValue, float64(ready[key]), cr.Namespace, cr.Name)
+
+		// from status, the snapshot jobs are deleted once their step is done
+		if t := cr.Status.LastSnapshotTime; t != nil {
+			ch <- prometheus.MustNewConstMetric(snapshotAgeDesc, prometheus.GaugeValue, time.Since(t.Time).Seconds(), cr.Namespace, cr.Name)
+		}
+	}
+
+	s.collectCerts(ctx, ch)
+}
+
+// readyMembers by namespace/name of the cluster
+func (s *ClusterCollector) readyMembers(ctx context.Context) map[string]int32 {
+	r := map[string]int32{}
+
+	list := &appsv1.StatefulSetList{}
+	err := s.Reader.List(ctx, list, client.MatchingLabels{labelRole: etcd})
+	if err != nil {
+		log.Warnf("collect statefulsets: %+v", err)
+		return r
+	}
+
+	for _, v := range list.Items {
+		r[v.Namespace+"/"+v.Labels[LabelCrName]] = v.Status.ReadyReplicas
+	}
+
+	return r
+}
+
+func (s *ClusterCollector) collectCerts(ctx context.Context, ch chan<- prometheus.Metric) {
+	list := &corev1.SecretList{}
+	err := s.Reader.List(ctx, list, client.MatchingLabels{labelRole: etcd})
+	if err != nil {
+		log.Warnf("collect secrets: %+v", err)
+		return
+	}
+
+	for _, secret := range list.Items {
+		for key, data := range secret.Data {
+			if !strings.HasSuffix(key, ".crt") {
+				continue
+			}
+
+			block, _ := pem.Decode(data)
+			if block == nil {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(certExpiryDesc, prometheus.GaugeValue, float64(cert.NotAfter.Unix()),
+				secret.Namespace, secret.Labels[LabelCrName], secret.Name, key)
+		}
+	}
+}
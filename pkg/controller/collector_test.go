@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/pki"
+)
+
+func TestClusterCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, dbv1.AddToScheme(scheme))
+
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1"},
+		Spec:       dbv1.EtcdSpec{Members: 3},
+		Status: dbv1.EtcdStatus{
+			Status:           dbv1.StatusPartialReady,
+			LastSnapshotTime: &metav1.Time{Time: time.Now().Add(-time.Hour)},
+		},
+	}
+	// not reconciled yet
+	pending := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "default", UID: "uid-2"},
+		Spec:       dbv1.EtcdSpec{Members: 1},
+	}
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Labels: MemberLabel(cr.ObjectMeta, SelectAll)},
+		Status:     appsv1.StatefulSetStatus{ReadyReplicas: 2},
+	}
+	ca, err := pki.NewCA("foo-ca")
+	require.NoError(t, err)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-ca", Namespace: "default", Labels: baseLabel(cr.ObjectMeta)},
+		Data:       map[string][]byte{CACertKey: ca.CertPEM, caKeyKey: ca.KeyPEM},
+	}
+
+	c := &ClusterCollector{
+		Reader: fake.NewClientBuilder().WithScheme(scheme).WithObjects(cr, pending, sts, secret).Build(),
+	}
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(c))
+
+	// 4 statuses, desired and ready of both, one snapshot age, one cert
+	n, err := testutil.GatherAndCount(reg)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "etcd_operator_cluster_members_ready" {
+			// sorted by labels, bar then foo
+			require.Equal(t, float64(0), mf.GetMetric()[0].GetGauge().GetValue())
+			require.Equal(t, float64(2), mf.GetMetric()[1].GetGauge().GetValue())
+		}
+		if mf.GetName() == "etcd_operator_clusters" {
+			for _, m := range mf.GetMetric() {
+				require.NotEmpty(t, m.GetLabel()[0].GetValue())
+			}
+		}
+		if mf.GetName() == "etcd_operator_cluster_last_snapshot_age_seconds" {
+			require.Len(t, mf.GetMetric(), 1)
+			require.InDelta(t, time.Hour.Seconds(), mf.GetMetric()[0].GetGauge().GetValue(), 60)
+		}
+		if mf.GetName() == "etcd_operator_certificate_expiry_timestamp_seconds" {
+			require.Equal(t, float64(ca.Cert.NotAfter.Unix()), mf.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	errors2 "github.com/pkg/errors"
+	"github.com/win5do/go-lib/errx"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+const (
+	// Ref: https://github.com/servicebinding/spec#well-known-secret-entries
+	bindingType     = "etcd"
+	bindingProvider = "etcd-operator"
+
+	secretTypeBinding corev1.SecretType = "servicebinding.io/" + bindingType
+)
+
+// SyncConnectionSecret publishes how applications connect to the cluster, in the Service Binding layout.
+// It is rebuilt on every reconcile, so it follows changes of members, Services, certs and credentials.
+func (s *controller) SyncConnectionSecret(addrs []string) error {
+	cr := s.cr
+
+	data, err := s.connectionData(addrs)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	name := cr.ConnectionSecretName()
+	meta := s.Builder.secretMetadata(name, connectionLabel(cr.ObjectMeta), connection)
+	found := &corev1.Secret{}
+	err = s.findSecret(name, found)
+	if k8serr.IsNotFound(err) {
+		err = s.Kcli.SetRefAndCreateObject(s.ctx, &corev1.Secret{
+			ObjectMeta: meta,
+			Type:       secretTypeBinding,
+			Data:       data,
+		})
+	} else if err == nil && !metav1.IsControlledBy(found, cr) {
+		// never take over a Secret someone else wrote
+		err = errors2.Wrapf(rerr.Err_invalid_spec, "secret %s exists and is not controlled by etcd %s", name, cr.Name)
+	} else if err == nil && !reflect.DeepEqual(found.Data, data) {
+		s.reqLog.Infof("update connection secret %s", name)
+		err = s.Kcli.UpdateObject(s.ctx, found, func() error {
+			found.Data = data
+			found.Labels = MergeLabels(found.Labels, meta.Labels)
+			found.Annotations = MergeLabels(found.Annotations, meta.Annotations)
+			return nil
+		})
+	} else if err == nil {
+		err = s.syncMetadata(found, meta)
+	}
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	// spec.connectionSecret renamed
+	list := &corev1.SecretList{}
+	err = s.Kcli.ListByLabel(s.ctx, cr.Namespace, connectionLabel(cr.ObjectMeta), list)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	for i := range list.Items {
+		if list.Items[i].Name == name {
+			continue
+		}
+
+		err := s.Kcli.DeleteObject(s.ctx, &list.Items[i])
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+	}
+
+	return nil
+}
+
+// connectionData addrs are the client addresses reported in status.connectAddr
+func (s *controller) connectionData(addrs []string) (map[string][]byte, error) {
+	cr := s.cr
+
+	host := fmt.Sprintf("%s.%s.svc", cr.Name, cr.Namespace)
+	if exposure(cr) == dbv1.ServiceExposureClusterIP {
+		host = fmt.Sprintf("%s.%s.svc", AddSuffix(cr.Name, Client), cr.Namespace)
+	}
+
+	data := map[string][]byte{
+		"type":      []byte(bindingType),
+		"provider":  []byte(bindingProvider),
+		"host":      []byte(host),
+		"port":      []byte(strconv.Itoa(portClient)),
+		"endpoints": []byte(strings.Join(memberEndpoints(cr), ",")),
+	}
+
+	switch exposure(cr) {
+	case dbv1.ServiceExposureNodePort, dbv1.ServiceExposureLoadBalancer, dbv1.ServiceExposureSharedLoadBalancer:
+		var external []string
+		for _, v := range addrs {
+			external = append(external, scheme(cr)+"://"+v)
+		}
+		data["external-endpoints"] = []byte(strings.Join(external, ","))
+	}
+
+	// the app user and cert, root stays with the operator
+	if cr.TLSEnabled() {
+		found := &corev1.Secret{}
+		err := s.Kcli.Find(s.ctx, cr.AppTLSSecretName(), cr.Namespace, found)
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+
+		for _, k := range []string{CACertKey, corev1.TLSCertKey, corev1.TLSPrivateKeyKey} {
+			data[k] = found.Data[k]
+		}
+	}
+
+	if cr.AuthEnabled() {
+		password, err := s.password(cr.AppAuthSecretName())
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+
+		data[corev1.BasicAuthUsernameKey] = []byte(appUser)
+		data[corev1.BasicAuthPasswordKey] = []byte(password)
+	}
+
+	return data, nil
+}
+
+// findSecret reads through the cache, which only holds the Secrets labelled by the operator,
+// a miss is confirmed with the API server so a Secret written by someone else is not taken as missing
+func (s *controller) findSecret(name string, found *corev1.Secret) error {
+	err := s.Kcli.Find(s.ctx, name, s.cr.Namespace, found)
+	if k8serr.IsNotFound(err) {
+		return s.Kcli.FindLatest(s.ctx, name, s.cr.Namespace, found)
+	}
+
+	return err
+}
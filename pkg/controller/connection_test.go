@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/k8s"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+func TestConnectionData(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 2,
+			Service: &dbv1.ServiceSpec{Type: dbv1.ServiceExposureNodePort},
+		},
+	}
+	ct := &controller{cr: cr}
+
+	data, err := ct.connectionData([]string{"node:30001", "node:30002"})
+	require.NoError(t, err)
+	require.Equal(t, "etcd", string(data["type"]))
+	require.Equal(t, "etcd-operator", string(data["provider"]))
+	require.Equal(t, "foo.default.svc", string(data["host"]))
+	require.Equal(t, "2379", string(data["port"]))
+	require.Equal(t, "http://foo-0.foo.default.svc:2379,http://foo-1.foo.default.svc:2379", string(data["endpoints"]))
+	require.Equal(t, "http://node:30001,http://node:30002", string(data["external-endpoints"]))
+	require.NotContains(t, data, "password")
+
+	cr.Spec.Service.Type = dbv1.ServiceExposureClusterIP
+	data, err = ct.connectionData([]string{"foo-client.default.svc:2379"})
+	require.NoError(t, err)
+	require.Equal(t, "foo-client.default.svc", string(data["host"]))
+	require.NotContains(t, data, "external-endpoints")
+}
+
+func TestSyncConnectionSecretNotControlled(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, dbv1.AddToScheme(scheme))
+
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			UID:       "uid-1",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members:          1,
+			ConnectionSecret: "app",
+			Service:          &dbv1.ServiceSpec{Type: dbv1.ServiceExposureNone},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Data:       map[string][]byte{"password": []byte("keep")},
+	}).Build()
+	// not labelled by the operator, so missing from the cache
+	cached := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ct := &controller{
+		ctx:     ctx,
+		reqLog:  zap.NewNop().Sugar(),
+		cr:      cr,
+		Builder: NewResourceBuilder(cr),
+		Kcli:    k8s.NewKcli(cached, cli, scheme, nil, cr, nil),
+	}
+
+	err := ct.SyncConnectionSecret(nil)
+	require.True(t, errors.Is(err, rerr.Err_invalid_spec))
+
+	found := &corev1.Secret{}
+	require.NoError(t, cli.Get(ctx, types.NamespacedName{Name: "app", Namespace: "default"}, found))
+	require.Equal(t, "keep", string(found.Data["password"]))
+}
+
+func TestSecretMetadata(t *testing.T) {
+	ctx := context.Background()
+	cr := testEtcd(1)
+	cr.UID = "uid-1"
+	cr.Spec.Service = &dbv1.ServiceSpec{Type: dbv1.ServiceExposureNone}
+	cr.Spec.Auth = &dbv1.AuthSpec{Enabled: true}
+	cr.Status.AuthEnabled = true
+	cr.Status.AppUser = appUser
+	cr.Spec.Metadata = &dbv1.ResourceMetadata{
+		ObjectMetadata: dbv1.ObjectMetadata{Labels: map[string]string{"cost-center": "db"}},
+	}
+	ct, cli := newFakeController(t, cr)
+
+	require.NoError(t, ct.SyncAuth())
+	require.NoError(t, ct.SyncConnectionSecret(nil))
+
+	for _, name := range []string{cr.ConnectionSecretName(), cr.AuthSecretName(), cr.AppAuthSecretName()} {
+		found := &corev1.Secret{}
+		require.NoError(t, cli.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, found))
+		require.Equal(t, "db", found.Labels["cost-center"], name)
+		require.Equal(t, "foo", found.Labels[labelAppInstance], name)
+	}
+
+	// added to spec.metadata later
+	cr.Spec.Metadata.Annotations = map[string]string{"owner": "team-a"}
+	require.NoError(t, ct.SyncAuth())
+	require.NoError(t, ct.SyncConnectionSecret(nil))
+
+	for _, name := range []string{cr.ConnectionSecretName(), cr.AuthSecretName(), cr.AppAuthSecretName()} {
+		found := &corev1.Secret{}
+		require.NoError(t, cli.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, found))
+		require.Equal(t, "team-a", found.Annotations["owner"], name)
+	}
+}
+
+func TestConnectionCredentials(t *testing.T) {
+	ctx := context.Background()
+	cr := testEtcd(1)
+	cr.UID = "uid-1"
+	cr.Spec.Service = &dbv1.ServiceSpec{Type: dbv1.ServiceExposureNone}
+	cr.Spec.TLS = &dbv1.TLSSpec{Enabled: true}
+	cr.Spec.Auth = &dbv1.AuthSpec{Enabled: true}
+	cr.Status.AuthEnabled = true
+	cr.Status.AppUser = appUser
+	ct, cli := newFakeController(t, cr)
+
+	require.NoError(t, ct.SyncTLS())
+	require.NoError(t, ct.SyncAuth())
+	require.NoError(t, ct.SyncConnectionSecret(nil))
+
+	get := func(name string) *corev1.Secret {
+		found := &corev1.Secret{}
+		require.NoError(t, cli.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, found))
+		return found
+	}
+	conn := get(cr.ConnectionSecretName())
+	root := get(cr.AuthSecretName())
+	app := get(cr.AppAuthSecretName())
+
+	// never the root credentials of the operator
+	require.Equal(t, appUser, string(conn.Data[corev1.BasicAuthUsernameKey]))
+	require.Equal(t, app.Data[corev1.BasicAuthPasswordKey], conn.Data[corev1.BasicAuthPasswordKey])
+	require.NotEqual(t, root.Data[corev1.BasicAuthPasswordKey], conn.Data[corev1.BasicAuthPasswordKey])
+
+	require.Equal(t, get(cr.AppTLSSecretName()).Data[corev1.TLSCertKey], conn.Data[corev1.TLSCertKey])
+	require.NotEqual(t, get(cr.ClientTLSSecretName()).Data[corev1.TLSCertKey], conn.Data[corev1.TLSCertKey])
+
+	block, _ := pem.Decode(conn.Data[corev1.TLSCertKey])
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, appUser, cert.Subject.CommonName)
+}
@@ -1,6 +1,8 @@
 package controller
 
 import (
+	"context"
+
 	"go.uber.org/zap"
 
 	dbv1 "github.com/win5do/etcd-operator/api/v1"
@@ -9,6 +11,8 @@ import (
 )
 
 type controller struct {
+	// ctx of the reconcile, canceled on shutdown
+	ctx    context.Context
 	reqLog *zap.SugaredLogger
 	cr     *dbv1.Etcd
 	cfg    conf.Config
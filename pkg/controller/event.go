@@ -0,0 +1,12 @@
+package controller
+
+// event reasons, Created and Updated of generated objects are recorded by Kcli
+const (
+	ReasonRollingUpdate = "RollingUpdate"
+	ReasonServicePruned = "ServicePruned"
+	ReasonFinalizing    = "Finalizing"
+	ReasonFinalized     = "Finalized"
+	ReasonStatusChanged = "StatusChanged"
+	ReasonSnapshotFail  = "SnapshotFailed"
+	ReasonSnapshotSkip  = "SnapshotSkipped"
+)
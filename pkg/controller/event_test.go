@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/k8s"
+)
+
+func TestEvents(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, dbv1.AddToScheme(scheme))
+
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1"},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cr).Build()
+	fr := record.NewFakeRecorder(10)
+	kcli := k8s.NewKcli(cli, nil, scheme, nil, cr, k8s.NewDedupRecorder(fr, time.Minute))
+
+	ctx := context.Background()
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	require.NoError(t, kcli.CreateObject(ctx, svc))
+	require.Equal(t, "Normal Created created Service foo", <-fr.Events)
+
+	// updates of the owner itself, e.g. finalizers, are left out
+	require.NoError(t, kcli.UpdateObject(ctx, cr, nil))
+
+	// repeated by requeue
+	for i := 0; i < 3; i++ {
+		kcli.Event(corev1.EventTypeWarning, ReasonStatusChanged, "status changed from %q to %q", dbv1.StatusReady, dbv1.StatusFailed)
+	}
+	require.Equal(t, `Warning StatusChanged status changed from "Ready" to "Failed"`, <-fr.Events)
+	require.Empty(t, fr.Events)
+
+	// the status went back and forth since, a new transition
+	cr.Status.Status = dbv1.StatusReady
+	require.NoError(t, kcli.WriteStatus(ctx, cr))
+	kcli.Event(corev1.EventTypeWarning, ReasonStatusChanged, "status changed from %q to %q", dbv1.StatusReady, dbv1.StatusFailed)
+	require.Equal(t, `Warning StatusChanged status changed from "Ready" to "Failed"`, <-fr.Events)
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/conf"
+)
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, dbv1.AddToScheme(scheme))
+	return scheme
+}
+
+// newFakeController a controller for cr backed by a fake client holding cr and objs
+func newFakeController(t *testing.T, cr *dbv1.Etcd, objs ...client.Object) (*controller, client.Client) {
+	scheme := testScheme(t)
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(objs, cr)...).Build()
+
+	// as read by the reconcile
+	require.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(cr), cr))
+
+	ct := Inject(context.Background(), cli, nil, scheme, cr, zap.NewNop().Sugar(), conf.Config{}, nil)
+	return ct, cli
+}
+
+// testEtcd the cluster most tests start from, foo in default
+func testEtcd(members int) *dbv1.Etcd {
+	return &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: members,
+		},
+	}
+}
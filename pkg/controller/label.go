@@ -6,25 +6,103 @@ import (
 
 	log "github.com/win5do/go-lib/logx"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/win5do/etcd-operator/pkg/cache"
 )
 
 const (
-	labelRole = "role"
-	etcd      = "etcd"
-	Export    = "export"
-	SelectAll = -999
-	SpecHash  = "etcd-operator/spec-hash"
+	labelRole      = "role"
+	labelComponent = "component"
+	etcd           = "etcd"
+	snapshot       = "snapshot"
+	inspect        = "inspect"
+	connection     = "connection"
+	certSecrets    = "tls"
+	authSecret     = "auth"
+	Export         = "export"
+	Client         = "client"
+	SelectAll      = -999
+	Orphaned       = "etcd-operator/orphaned"
+
+	// labelSnapshotFor what a snapshot job was taken for, e.g. upgrade
+	labelSnapshotFor = "etcd-operator/snapshot-for"
+	snapshotUpgrade  = "upgrade"
+	snapshotFinal    = "final"
+
+	LabelCrName = "cr-name"
+	LabelCrUID  = "cr-uid"
+
+	// https://kubernetes.io/docs/concepts/overview/working-with-objects/common-labels/
+	labelAppName      = "app.kubernetes.io/name"
+	labelAppInstance  = "app.kubernetes.io/instance"
+	labelAppComponent = "app.kubernetes.io/component"
+	labelAppManagedBy = "app.kubernetes.io/managed-by"
+	managedBy         = "etcd-operator"
+	member            = "member"
+
+	labelControlPlane = "control-plane"
 )
 
 // cr的所有资源都打上这个label
 func baseLabel(meta metav1.ObjectMeta) map[string]string {
 	return map[string]string{
-		"cr-name": meta.Name,
-		"cr-uid":  string(meta.UID), // 使用uid，比name更安全
-		labelRole: etcd,
+		LabelCrName: meta.Name,
+		LabelCrUID:  string(meta.UID), // 使用uid，比name更安全
+		labelRole:   etcd,
+	}
+}
+
+func jobLabel(meta metav1.ObjectMeta, component string) map[string]string {
+	return MergeLabels(baseLabel(meta), map[string]string{
+		labelComponent: component,
+	})
+}
+
+// Kubernetes 推荐的 label，不参与 selector
+func appLabel(meta metav1.ObjectMeta, component string) map[string]string {
+	r := map[string]string{
+		labelAppName:      etcd,
+		labelAppInstance:  meta.Name,
+		labelAppManagedBy: managedBy,
+	}
+	if component != "" {
+		r[labelAppComponent] = component
+	}
+
+	return r
+}
+
+// 发布给应用的连接信息 Secret
+func connectionLabel(meta metav1.ObjectMeta) map[string]string {
+	return MergeLabels(baseLabel(meta), map[string]string{
+		labelComponent: connection,
+	})
+}
+
+// job pod 不带 role label，避免被 member selector 选中
+func jobPodLabel(meta metav1.ObjectMeta, component string) map[string]string {
+	return map[string]string{
+		LabelCrName:    meta.Name,
+		LabelCrUID:     string(meta.UID),
+		labelComponent: component,
+	}
+}
+
+// PVC 在 cr 删除后保留时打上这个label
+func orphanedLabel() map[string]string {
+	return map[string]string{
+		Orphaned: "true",
 	}
 }
 
+// PVCs retained by an earlier cluster of the same name
+func orphanedPVCLabel(name string) map[string]string {
+	return MergeLabels(map[string]string{
+		LabelCrName: name,
+	}, orphanedLabel())
+}
+
 func exportLabel() map[string]string {
 	return map[string]string{
 		"svc": Export,
@@ -66,6 +144,37 @@ func MemberLabel(meta metav1.ObjectMeta, id int) map[string]string {
 	return r
 }
 
+// CacheSelectors 只缓存 operator 创建的对象，按 role label 选择；
+// job pod 不带 role label，pod 按 member 和 job pod 都有的 cr-name 和 cr-uid 选择
+func CacheSelectors() cache.Selectors {
+	role := labels.Set{labelRole: etcd}.String()
+	pod := LabelCrName + "," + LabelCrUID
+
+	return cache.Selectors{
+		{Resource: "services"}:                    role,
+		{Resource: "persistentvolumeclaims"}:      role,
+		{Resource: "secrets"}:                     role,
+		{Group: "apps", Resource: "statefulsets"}: role,
+		{Group: "batch", Resource: "jobs"}:        role,
+		{Resource: "pods"}:                        pod,
+	}
+}
+
+// operator pod 的 label，见 config/manager/manager.yaml
+func operatorLabel() map[string]string {
+	return map[string]string{
+		labelAppName: managedBy,
+	}
+}
+
+// operator 所在 namespace 的 label，见 config/manager/manager.yaml。
+// kubernetes.io/metadata.name 要 k8s 1.21 才自动打上，不能依赖
+func operatorNamespaceLabel() map[string]string {
+	return map[string]string{
+		labelControlPlane: "controller-manager",
+	}
+}
+
 // MergeLabels merges all the label maps received as argument into a single new label map.
 func MergeLabels(allLabels ...map[string]string) map[string]string {
 	res := map[string]string{}
@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestCacheSelectors(t *testing.T) {
+	cr := testEtcd(1)
+	cr.UID = "uid-1"
+	cr.Spec.Storage = "1Gi"
+	b := NewResourceBuilder(cr)
+
+	selector := func(gr schema.GroupResource) labels.Selector {
+		s, err := labels.Parse(CacheSelectors()[gr])
+		require.NoError(t, err)
+		return s
+	}
+	pods := selector(schema.GroupResource{Resource: "pods"})
+
+	// member and job pods are cached, the job pods carry no role label
+	sts := b.StatefulSet(MemberLabel(cr.ObjectMeta, 0))
+	require.True(t, pods.Matches(labels.Set(sts.Spec.Template.Labels)))
+	job := b.SnapshotJob("foo-snapshot", "foo.db", &dbv1.SnapshotDestination{PVC: &dbv1.PVCDestination{ClaimName: "backup"}})
+	require.True(t, pods.Matches(labels.Set(job.Spec.Template.Labels)))
+	require.False(t, pods.Matches(labels.Set{LabelCrUID: "uid-1"}))
+	require.False(t, pods.Matches(labels.Set{LabelCrName: "foo"}))
+
+	secrets := selector(schema.GroupResource{Resource: "secrets"})
+	require.True(t, secrets.Matches(labels.Set(connectionLabel(cr.ObjectMeta))))
+	require.False(t, secrets.Matches(labels.Set{}))
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"github.com/win5do/go-lib/errx"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrlcli "sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+type metadataKind int
+
+const (
+	kindOther metadataKind = iota
+	kindPod
+	kindService
+	kindPVC
+	kindStatefulSet
+)
+
+// withMetadata adds spec.metadata and the app.kubernetes.io labels to meta,
+// labels and annotations already set by the operator win so selectors are never overwritten.
+// Pod templates only get spec.metadata, new operator labels would change the template and roll every member on upgrade.
+func (s *ResourceBuilder) withMetadata(meta *metav1.ObjectMeta, kind metadataKind, component string) {
+	labels, annotations := s.userMetadata(kind)
+
+	var app map[string]string
+	if kind != kindPod {
+		app = appLabel(s.cr.ObjectMeta, component)
+	}
+	meta.Labels = MergeLabels(labels, app, meta.Labels)
+
+	annotations = MergeLabels(annotations, meta.Annotations)
+	if len(annotations) > 0 {
+		meta.Annotations = annotations
+	}
+}
+
+// userMetadata common labels and annotations merged with those of kind
+func (s *ResourceBuilder) userMetadata(kind metadataKind) (map[string]string, map[string]string) {
+	m := s.cr.Spec.Metadata
+	if m == nil {
+		return nil, nil
+	}
+
+	var o *dbv1.ObjectMetadata
+	switch kind {
+	case kindPod:
+		o = m.Pods
+	case kindService:
+		o = m.Services
+	case kindPVC:
+		o = m.PersistentVolumeClaims
+	case kindStatefulSet:
+		o = m.StatefulSet
+	}
+
+	if o == nil {
+		return m.Labels, m.Annotations
+	}
+
+	return MergeLabels(m.Labels, o.Labels), MergeLabels(m.Annotations, o.Annotations)
+}
+
+// secretMetadata metadata of a Secret written by the operator
+func (s *ResourceBuilder) secretMetadata(name string, labels map[string]string, component string) metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Name:      name,
+		Namespace: s.cr.Namespace,
+		Labels:    labels,
+	}
+	s.withMetadata(&meta, kindOther, component)
+
+	return meta
+}
+
+func (s *ResourceBuilder) jobMetadata(obj *batchv1.Job, component string) *batchv1.Job {
+	s.withMetadata(&obj.ObjectMeta, kindOther, component)
+	s.withMetadata(&obj.Spec.Template.ObjectMeta, kindPod, component)
+
+	return obj
+}
+
+// syncMetadata adds the labels and annotations of template missing from obj,
+// those removed from spec.metadata are left on it
+func (s *controller) syncMetadata(obj ctrlcli.Object, template metav1.ObjectMeta) error {
+	if hasAll(obj.GetLabels(), template.Labels) && hasAll(obj.GetAnnotations(), template.Annotations) {
+		return nil
+	}
+
+	s.reqLog.Infof("sync metadata of %s", obj.GetName())
+	// a null would remove every key in a merge patch
+	meta := map[string]interface{}{}
+	if len(template.Labels) > 0 {
+		meta["labels"] = template.Labels
+	}
+	if len(template.Annotations) > 0 {
+		meta["annotations"] = template.Annotations
+	}
+	err := s.Kcli.MergePatchObject(s.ctx, obj, map[string]interface{}{"metadata": meta})
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+func hasAll(m, sub map[string]string) bool {
+	for k, v := range sub {
+		if got, ok := m[k]; !ok || got != v {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestWithMetadata(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			UID:       "uid-1",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+			Storage: "1Gi",
+			Service: &dbv1.ServiceSpec{Annotations: map[string]string{"lb": "internal"}},
+			Metadata: &dbv1.ResourceMetadata{
+				ObjectMetadata: dbv1.ObjectMetadata{
+					Labels:      map[string]string{"cost-center": "db", LabelCrName: "other"},
+					Annotations: map[string]string{"owner": "team-a"},
+				},
+				Pods: &dbv1.ObjectMetadata{
+					Labels:      map[string]string{"cost-center": "db-pods"},
+					Annotations: map[string]string{"prometheus.io/scrape": "true"},
+				},
+				Services: &dbv1.ObjectMetadata{Annotations: map[string]string{"lb": "external"}},
+			},
+		},
+	}
+	b := NewResourceBuilder(cr)
+
+	sts := b.StatefulSet(MemberLabel(cr.ObjectMeta, SelectAll))
+	require.Equal(t, "db", sts.Labels["cost-center"])
+	require.Equal(t, "foo", sts.Labels[LabelCrName])
+	require.Equal(t, "foo", sts.Labels[labelAppInstance])
+	require.Equal(t, MemberLabel(cr.ObjectMeta, SelectAll), sts.Spec.Selector.MatchLabels)
+	require.Equal(t, "team-a", sts.Annotations["owner"])
+
+	tpl := sts.Spec.Template
+	require.Equal(t, "db-pods", tpl.Labels["cost-center"])
+	// the template of existing clusters is unchanged, so upgrading the operator rolls no member
+	require.Equal(t, MergeLabels(MemberLabel(cr.ObjectMeta, SelectAll), map[string]string{"cost-center": "db-pods"}), tpl.Labels)
+	require.Equal(t, "true", tpl.Annotations["prometheus.io/scrape"])
+	require.Equal(t, "db", sts.Spec.VolumeClaimTemplates[0].Labels["cost-center"])
+
+	svc := b.ExportService("foo-export-0", corev1.ServiceTypeNodePort, ExportSvcLabel(cr.ObjectMeta, 0), nil)
+	require.Equal(t, "internal", svc.Annotations["lb"])
+	require.Equal(t, "team-a", svc.Annotations["owner"])
+	require.Equal(t, Client, svc.Labels[labelAppComponent])
+
+	job := b.SnapshotJob("foo-snapshot", "foo.db", &dbv1.SnapshotDestination{PVC: &dbv1.PVCDestination{ClaimName: "foo-snapshot"}})
+	require.Equal(t, "db-pods", job.Spec.Template.Labels["cost-center"])
+	require.NotContains(t, job.Spec.Template.Labels, labelRole)
+	require.NotContains(t, job.Spec.Template.Labels, labelAppInstance)
+	require.Equal(t, snapshot, job.Labels[labelAppComponent])
+}
@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/win5do/go-lib/errx"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+// prometheus-operator types are not vendored, monitors are built as unstructured
+var monitoringGV = schema.GroupVersion{Group: "monitoring.coreos.com", Version: "v1"}
+
+const metricsComponent = "metrics"
+
+// SyncMonitor creates the ServiceMonitor or PodMonitor of spec.monitoring,
+// nothing is done while the prometheus-operator CRDs are not installed
+func (s *controller) SyncMonitor() error {
+	cr := s.cr
+
+	var kind dbv1.MonitorKind
+	if cr.Spec.Monitoring != nil {
+		kind = cr.Spec.Monitoring.Kind
+	}
+
+	if cr.Status.Monitor != "" && cr.Status.Monitor != kind {
+		s.reqLog.Infof("monitor kind changed from %s, delete it", cr.Status.Monitor)
+		err := s.deleteUnstructured(s.Builder.Monitor(cr.Name, cr.Status.Monitor))
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+
+		cr.Status.Monitor = ""
+		s.writeStatus()
+	}
+
+	if kind == "" {
+		return nil
+	}
+
+	ok, err := s.syncUnstructured(s.Builder.Monitor(cr.Name, kind))
+	if err != nil || !ok {
+		return err
+	}
+
+	if cr.Status.Monitor != kind {
+		cr.Status.Monitor = kind
+		s.writeStatus()
+	}
+
+	return nil
+}
+
+// syncUnstructured applies newObj, false when the kind is not served, e.g. the prometheus-operator CRDs are not installed
+func (s *controller) syncUnstructured(newObj *unstructured.Unstructured) (bool, error) {
+	gvk := newObj.GroupVersionKind()
+	ok, err := s.Kcli.HasKind(gvk)
+	if err != nil {
+		return false, errx.WithStackOnce(err)
+	}
+	if !ok {
+		s.reqLog.Debugf("%s CRD not installed, skip", gvk.Kind)
+		return false, nil
+	}
+
+	err = s.Kcli.Apply(s.ctx, newObj)
+	if err != nil {
+		return false, errx.WithStackOnce(err)
+	}
+
+	return true, nil
+}
+
+func (s *controller) deleteUnstructured(obj *unstructured.Unstructured) error {
+	ok, err := s.Kcli.HasKind(obj.GroupVersionKind())
+	if err != nil || !ok {
+		// CRD removed along with its objects
+		return err
+	}
+
+	return s.Kcli.DeleteObject(s.ctx, obj)
+}
+
+func newMonitor(kind dbv1.MonitorKind) *unstructured.Unstructured {
+	r := &unstructured.Unstructured{}
+	r.SetGroupVersionKind(monitoringGV.WithKind(string(kind)))
+	return r
+}
+
+// metricsServicePort of the headless Service, the ServiceMonitor scrapes it by name
+func (s *ResourceBuilder) metricsServicePort() corev1.ServicePort {
+	r := corev1.ServicePort{
+		Name:       PortMetricsName,
+		Port:       portMetrics,
+		TargetPort: intstr.FromString(PortMetricsName),
+		Protocol:   corev1.ProtocolTCP,
+	}
+
+	if s.cr.MetricsTLS() {
+		r.Port = portMetricsTLS
+		r.TargetPort = intstr.FromString(PortMetricsTLSName)
+	}
+
+	return r
+}
+
+// Monitor ServiceMonitor selecting the headless Service, or PodMonitor selecting the members
+func (s *ResourceBuilder) Monitor(name string, kind dbv1.MonitorKind) *unstructured.Unstructured {
+	cr := s.cr
+	m := cr.Spec.Monitoring
+	if m == nil {
+		m = &dbv1.MonitoringSpec{}
+	}
+
+	endpoint := map[string]interface{}{
+		"path": "/metrics",
+	}
+	if m.Interval != "" {
+		endpoint["interval"] = m.Interval
+	}
+	if r := relabelings(m.ScrapeLabels); len(r) > 0 {
+		endpoint["relabelings"] = r
+	}
+	if cr.MetricsTLS() {
+		endpoint["scheme"] = "https"
+		endpoint["tlsConfig"] = s.monitorTLSConfig()
+	}
+
+	selector := map[string]interface{}{
+		"matchLabels": stringMap(MemberLabel(cr.ObjectMeta, SelectAll)),
+	}
+
+	var spec map[string]interface{}
+	switch kind {
+	case dbv1.PodMonitor:
+		endpoint["port"] = PortMetricsName
+		if cr.MetricsTLS() {
+			endpoint["port"] = PortMetricsTLSName
+		}
+		spec = map[string]interface{}{
+			"selector":            selector,
+			"podMetricsEndpoints": []interface{}{endpoint},
+		}
+	default:
+		endpoint["port"] = PortMetricsName
+		// the client Services carry the member labels too
+		selector["matchExpressions"] = []interface{}{
+			map[string]interface{}{"key": "svc", "operator": "DoesNotExist"},
+		}
+		spec = map[string]interface{}{
+			"selector":  selector,
+			"endpoints": []interface{}{endpoint},
+		}
+	}
+
+	obj := newMonitor(kind)
+	obj.SetName(name)
+	obj.SetNamespace(cr.Namespace)
+	obj.Object["spec"] = spec
+
+	return s.finishUnstructured(obj, m.Labels, metricsComponent)
+}
+
+// finishUnstructured sets the labels and annotations of a prometheus-operator object,
+// extra labels let the Prometheus select it
+func (s *ResourceBuilder) finishUnstructured(obj *unstructured.Unstructured, extra map[string]string, component string) *unstructured.Unstructured {
+	om := metav1.ObjectMeta{
+		Labels: MergeLabels(extra, baseLabel(s.cr.ObjectMeta)),
+	}
+	s.withMetadata(&om, kindOther, component)
+	obj.SetLabels(om.Labels)
+	obj.SetAnnotations(om.Annotations)
+
+	return obj
+}
+
+// monitorTLSConfig scrape with the client cert, the Secret lives next to the monitor
+func (s *ResourceBuilder) monitorTLSConfig() map[string]interface{} {
+	cr := s.cr
+
+	secretKey := func(key string) map[string]interface{} {
+		return map[string]interface{}{
+			"name": cr.ClientTLSSecretName(),
+			"key":  key,
+		}
+	}
+
+	return map[string]interface{}{
+		"ca":        map[string]interface{}{"secret": secretKey(CACertKey)},
+		"cert":      map[string]interface{}{"secret": secretKey(corev1.TLSCertKey)},
+		"keySecret": secretKey(corev1.TLSPrivateKeyKey),
+		// targets are pod IPs, verify against a name in the serving cert
+		"serverName": fmt.Sprintf("%s.%s.svc", cr.Name, cr.Namespace),
+	}
+}
+
+// relabelings set a fixed value for each label, sorted to keep the hash stable
+func relabelings(labels map[string]string) []interface{} {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var r []interface{}
+	for _, k := range keys {
+		r = append(r, map[string]interface{}{
+			"action":      "replace",
+			"targetLabel": k,
+			"replacement": labels[k],
+		})
+	}
+
+	return r
+}
+
+// stringMap unstructured content only holds interface{} values
+func stringMap(m map[string]string) map[string]interface{} {
+	r := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		r[k] = v
+	}
+	return r
+}
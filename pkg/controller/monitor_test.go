@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestMonitor(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			UID:       "uid-1",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+			TLS:     &dbv1.TLSSpec{Enabled: true},
+			Monitoring: &dbv1.MonitoringSpec{
+				Kind:         dbv1.ServiceMonitor,
+				Labels:       map[string]string{"release": "prometheus", LabelCrName: "other"},
+				ScrapeLabels: map[string]string{"cluster": "prod"},
+				Interval:     "30s",
+			},
+		},
+	}
+	b := NewResourceBuilder(cr)
+
+	obj := b.Monitor(cr.Name, dbv1.ServiceMonitor)
+	require.Equal(t, "ServiceMonitor", obj.GetKind())
+	require.Equal(t, "prometheus", obj.GetLabels()["release"])
+	require.Equal(t, "foo", obj.GetLabels()[LabelCrName])
+
+	endpoints, _, _ := unstructured.NestedSlice(obj.Object, "spec", "endpoints")
+	require.Len(t, endpoints, 1)
+	ep := endpoints[0].(map[string]interface{})
+	require.Equal(t, PortMetricsName, ep["port"])
+	require.Equal(t, "30s", ep["interval"])
+	require.Nil(t, ep["scheme"])
+	require.Len(t, ep["relabelings"], 1)
+	// deep copy panics on values unstructured can not hold
+	require.NotPanics(t, func() { obj.DeepCopy() })
+
+	require.Equal(t, PortMetricsName, b.metricsServicePort().Name)
+	require.Equal(t, int32(portMetrics), b.metricsServicePort().Port)
+	require.NotContains(t, b.metricsURLs(), "https")
+
+	cr.Spec.Monitoring.TLS = true
+	obj = b.Monitor(cr.Name, dbv1.PodMonitor)
+	endpoints, _, _ = unstructured.NestedSlice(obj.Object, "spec", "podMetricsEndpoints")
+	ep = endpoints[0].(map[string]interface{})
+	require.Equal(t, PortMetricsTLSName, ep["port"])
+	require.Equal(t, "https", ep["scheme"])
+	serverName, _, _ := unstructured.NestedString(ep, "tlsConfig", "serverName")
+	require.Equal(t, "foo.default.svc", serverName)
+	require.Contains(t, b.metricsURLs(), "https://0.0.0.0:2382")
+	require.Equal(t, int32(portMetricsTLS), b.metricsServicePort().Port)
+}
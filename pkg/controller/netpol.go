@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"github.com/win5do/go-lib/errx"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// syncNetworkPolicy keeps the member NetworkPolicy in line with spec.networkPolicy, it is removed when unset
+func (s *controller) syncNetworkPolicy() error {
+	cr := s.cr
+
+	if cr.Spec.NetworkPolicy == nil {
+		found := &networkingv1.NetworkPolicy{}
+		ok, err := s.Kcli.IsExists(s.ctx, &metav1.ObjectMeta{Name: cr.Name, Namespace: cr.Namespace}, found)
+		if err != nil || !ok {
+			return err
+		}
+
+		s.reqLog.Info("networkPolicy unset, delete it")
+		return s.Kcli.DeleteObject(s.ctx, found)
+	}
+
+	newObj := s.Builder.NetworkPolicy(cr.Name, MemberLabel(cr.ObjectMeta, SelectAll))
+	// ingress rules are an atomic list, peers are replaced as a whole
+	err := s.Kcli.Apply(s.ctx, newObj)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestNetworkPolicy(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			UID:       "uid-1",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+			NetworkPolicy: &dbv1.NetworkPolicySpec{
+				AllowedClients: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}},
+				},
+			},
+		},
+	}
+
+	np := NewResourceBuilder(cr).NetworkPolicy("foo", MemberLabel(cr.ObjectMeta, SelectAll))
+	require.Len(t, np.Spec.Ingress, 2)
+
+	peer := np.Spec.Ingress[0]
+	require.Equal(t, int32(2380), peer.Ports[0].Port.IntVal)
+	require.Len(t, peer.From, 1)
+	require.Equal(t, MemberLabel(cr.ObjectMeta, SelectAll), peer.From[0].PodSelector.MatchLabels)
+
+	client := np.Spec.Ingress[1]
+	require.Equal(t, int32(2379), client.Ports[0].Port.IntVal)
+	require.Len(t, client.From, 3)
+	require.Equal(t, map[string]string{"control-plane": "controller-manager"}, client.From[1].NamespaceSelector.MatchLabels)
+	require.Equal(t, map[string]string{"app.kubernetes.io/name": "etcd-operator"}, client.From[1].PodSelector.MatchLabels)
+	require.Equal(t, "api", client.From[2].PodSelector.MatchLabels["app"])
+}
+
+func TestSyncNetworkPolicyUnset(t *testing.T) {
+	ctx := context.Background()
+	cr := testEtcd(1)
+	np := NewResourceBuilder(cr).NetworkPolicy("foo", MemberLabel(cr.ObjectMeta, SelectAll))
+	ct, cli := newFakeController(t, cr, np)
+
+	require.NoError(t, ct.syncNetworkPolicy())
+	require.True(t, k8serr.IsNotFound(cli.Get(ctx, client.ObjectKeyFromObject(np), &networkingv1.NetworkPolicy{})))
+
+	// nothing to remove
+	require.NoError(t, ct.syncNetworkPolicy())
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	errors2 "github.com/pkg/errors"
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+// CheckOverrides spec.overrides must keep the etcd container, its volumes and ports, and the Service ports.
+// Generated objects fall back to no override when they do not, this reports it as an invalid spec.
+func (s *controller) CheckOverrides() error {
+	cr := s.cr
+
+	if cr.Spec.Overrides == nil {
+		return nil
+	}
+
+	labels := MemberLabel(cr.ObjectMeta, SelectAll)
+
+	err := s.Builder.overrideStatefulSet(s.Builder.statefulSet(labels))
+	if err != nil {
+		return errors2.Wrapf(rerr.Err_invalid_spec, "spec.overrides.statefulSet: %v", err)
+	}
+
+	err = s.Builder.overrideService(s.Builder.headlessService(cr.Name, labels, labels))
+	if err != nil {
+		return errors2.Wrapf(rerr.Err_invalid_spec, "spec.overrides.services: %v", err)
+	}
+
+	return nil
+}
+
+// overrideStatefulSet applies spec.overrides.statefulSet, then puts back what the operator relies on.
+// obj is left without the override when it is invalid.
+func (s *ResourceBuilder) overrideStatefulSet(obj *appv1.StatefulSet) error {
+	o := s.cr.Spec.Overrides
+	if o == nil || o.StatefulSet == nil {
+		return nil
+	}
+
+	owned := obj.DeepCopy()
+	err := dbv1.MergeOverride(obj, o.StatefulSet)
+	if err != nil {
+		*obj = *owned
+		return err
+	}
+
+	obj.Name = owned.Name
+	obj.Namespace = owned.Namespace
+	obj.Labels = MergeLabels(obj.Labels, owned.Labels)
+	obj.Spec.Replicas = owned.Spec.Replicas
+	obj.Spec.Selector = owned.Spec.Selector
+	obj.Spec.ServiceName = owned.Spec.ServiceName
+	obj.Spec.PodManagementPolicy = owned.Spec.PodManagementPolicy
+	obj.Spec.UpdateStrategy = owned.Spec.UpdateStrategy
+	obj.Spec.VolumeClaimTemplates = owned.Spec.VolumeClaimTemplates
+	obj.Spec.Template.Labels = MergeLabels(obj.Spec.Template.Labels, owned.Spec.Template.Labels)
+
+	for i := range obj.Spec.Template.Spec.Containers {
+		c := &obj.Spec.Template.Spec.Containers[i]
+		if c.Name != etcd {
+			continue
+		}
+
+		// image is driven by upgrades
+		c.Image = owned.Spec.Template.Spec.Containers[0].Image
+		c.Command = owned.Spec.Template.Spec.Containers[0].Command
+	}
+
+	err = checkStatefulSet(owned, obj)
+	if err != nil {
+		*obj = *owned
+		return err
+	}
+
+	return nil
+}
+
+// checkStatefulSet obj still has the etcd container of owned with its mounts, volumes and ports
+func checkStatefulSet(owned, obj *appv1.StatefulSet) error {
+	want := owned.Spec.Template.Spec.Containers[0]
+
+	var got *corev1.Container
+	for i := range obj.Spec.Template.Spec.Containers {
+		if obj.Spec.Template.Spec.Containers[i].Name == want.Name {
+			got = &obj.Spec.Template.Spec.Containers[i]
+		}
+	}
+	if got == nil {
+		return errors2.Errorf("container %s removed", want.Name)
+	}
+
+	for _, m := range want.VolumeMounts {
+		if !hasMount(got.VolumeMounts, m) {
+			return errors2.Errorf("volumeMount %s of container %s removed or changed", m.Name, want.Name)
+		}
+	}
+
+	for _, p := range want.Ports {
+		if !hasContainerPort(got.Ports, p) {
+			return errors2.Errorf("port %s of container %s removed or changed", p.Name, want.Name)
+		}
+	}
+
+	for _, v := range owned.Spec.Template.Spec.Volumes {
+		if !hasVolume(obj.Spec.Template.Spec.Volumes, v) {
+			return errors2.Errorf("volume %s removed or changed", v.Name)
+		}
+	}
+
+	return nil
+}
+
+func hasMount(list []corev1.VolumeMount, m corev1.VolumeMount) bool {
+	for _, v := range list {
+		if v.Name == m.Name && v.MountPath == m.MountPath {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasContainerPort(list []corev1.ContainerPort, p corev1.ContainerPort) bool {
+	for _, v := range list {
+		if v.Name == p.Name && v.ContainerPort == p.ContainerPort {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasVolume(list []corev1.Volume, vol corev1.Volume) bool {
+	for _, v := range list {
+		if v.Name == vol.Name {
+			return equality.Semantic.DeepEqual(v.VolumeSource, vol.VolumeSource)
+		}
+	}
+
+	return false
+}
+
+// overrideService applies spec.overrides.services to every Service of the cluster.
+// obj is left without the override when it is invalid.
+func (s *ResourceBuilder) overrideService(obj *corev1.Service) error {
+	o := s.cr.Spec.Overrides
+	if o == nil || o.Services == nil {
+		return nil
+	}
+
+	owned := obj.DeepCopy()
+	err := dbv1.MergeOverride(obj, o.Services)
+	if err != nil {
+		*obj = *owned
+		return err
+	}
+
+	obj.Name = owned.Name
+	obj.Namespace = owned.Namespace
+	obj.Labels = MergeLabels(obj.Labels, owned.Labels)
+	obj.Spec.Selector = owned.Spec.Selector
+	obj.Spec.Type = owned.Spec.Type
+	obj.Spec.ClusterIP = owned.Spec.ClusterIP
+
+	for _, p := range owned.Spec.Ports {
+		if !hasServicePort(obj.Spec.Ports, p) {
+			*obj = *owned
+			return errors2.Errorf("port %s of service %s removed or changed", p.Name, owned.Name)
+		}
+	}
+
+	return nil
+}
+
+func hasServicePort(list []corev1.ServicePort, p corev1.ServicePort) bool {
+	for _, v := range list {
+		if v.Name == p.Name && v.Port == p.Port && v.TargetPort == p.TargetPort {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,18 @@
+package controller
+
+import (
+	"github.com/win5do/go-lib/errx"
+)
+
+// SyncPDB keeps maxUnavailable in line with spec.members, and the labels with spec.metadata
+func (s *controller) SyncPDB() error {
+	cr := s.cr
+
+	newObj := s.Builder.PodDisruptionBudget(cr.Name, MemberLabel(cr.ObjectMeta, SelectAll))
+	err := s.Kcli.Apply(s.ctx, newObj)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxUnavailable(t *testing.T) {
+	for members, want := range map[int]int{1: 1, 2: 1, 3: 1, 4: 1, 5: 2, 7: 3} {
+		require.Equal(t, want, maxUnavailable(members), members)
+	}
+}
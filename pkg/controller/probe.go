@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+// Ref: https://etcd.io/docs/v3.5/op-guide/monitoring/#health-check
+const (
+	pathReadyz = "/readyz"
+	pathLivez  = "/livez"
+	pathHealth = "/health"
+	// 3.5 before /readyz and /livez, older versions ignore the query
+	pathHealthSerializable = "/health?serializable=true"
+	pathHealthLive         = "/health?exclude=NOSPACE&serializable=true"
+)
+
+var (
+	defaultReadiness = dbv1.ProbeTiming{TimeoutSeconds: 5, PeriodSeconds: 10, FailureThreshold: 3}
+	defaultLiveness  = dbv1.ProbeTiming{TimeoutSeconds: 15, PeriodSeconds: 10, FailureThreshold: 8}
+	// 10 minutes to load the db and replay the wal
+	defaultStartup = dbv1.ProbeTiming{TimeoutSeconds: 15, PeriodSeconds: 10, FailureThreshold: 60}
+)
+
+// readinessProbe fails without a leader or with an alarm raised
+func (s *ResourceBuilder) readinessProbe() *corev1.Probe {
+	var r *corev1.Probe
+
+	v, ok := imageVersion(s.Image())
+	switch {
+	case ok && v.atLeast(3, 5, 11):
+		r = httpProbe(pathReadyz)
+	case ok && !v.atLeast(3, 5, 0):
+		r = httpProbe(pathHealth)
+	default:
+		r = httpProbe(pathHealthSerializable)
+	}
+
+	return withTiming(r, s.probeTiming(func(p *dbv1.ProbesSpec) *dbv1.ProbeTiming { return p.Readiness }), defaultReadiness)
+}
+
+// livenessProbe only restarts a member whose process is stuck, losing quorum or running out of space does not count
+func (s *ResourceBuilder) livenessProbe() *corev1.Probe {
+	return withTiming(s.liveCheck(), s.probeTiming(func(p *dbv1.ProbesSpec) *dbv1.ProbeTiming { return p.Liveness }), defaultLiveness)
+}
+
+func (s *ResourceBuilder) startupProbe() *corev1.Probe {
+	return withTiming(s.liveCheck(), s.probeTiming(func(p *dbv1.ProbesSpec) *dbv1.ProbeTiming { return p.Startup }), defaultStartup)
+}
+
+func (s *ResourceBuilder) liveCheck() *corev1.Probe {
+	v, ok := imageVersion(s.Image())
+	switch {
+	case ok && v.atLeast(3, 5, 11):
+		return httpProbe(pathLivez)
+	case ok && !v.atLeast(3, 5, 0):
+		// /health of 3.4 fails without a leader
+		return &corev1.Probe{
+			Handler: corev1.Handler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(portClient)},
+			},
+		}
+	default:
+		return httpProbe(pathHealthLive)
+	}
+}
+
+func (s *ResourceBuilder) probeTiming(get func(p *dbv1.ProbesSpec) *dbv1.ProbeTiming) *dbv1.ProbeTiming {
+	if s.cr.Spec.Probes == nil {
+		return nil
+	}
+
+	return get(s.cr.Spec.Probes)
+}
+
+func httpProbe(path string) *corev1.Probe {
+	return &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   path,
+				Port:   intstr.FromInt(portMetrics),
+				Scheme: corev1.URISchemeHTTP,
+			},
+		},
+	}
+}
+
+// withTiming fields left zero in t take the default
+func withTiming(r *corev1.Probe, t *dbv1.ProbeTiming, def dbv1.ProbeTiming) *corev1.Probe {
+	if t == nil {
+		t = &dbv1.ProbeTiming{}
+	}
+
+	pick := func(v, d int32) int32 {
+		if v > 0 {
+			return v
+		}
+		return d
+	}
+
+	r.InitialDelaySeconds = pick(t.InitialDelaySeconds, def.InitialDelaySeconds)
+	r.TimeoutSeconds = pick(t.TimeoutSeconds, def.TimeoutSeconds)
+	r.PeriodSeconds = pick(t.PeriodSeconds, def.PeriodSeconds)
+	r.FailureThreshold = pick(t.FailureThreshold, def.FailureThreshold)
+
+	return r
+}
+
+type etcdVersion struct {
+	Major, Minor, Patch int
+}
+
+func (v etcdVersion) atLeast(major, minor, patch int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	if v.Minor != minor {
+		return v.Minor > minor
+	}
+	return v.Patch >= patch
+}
+
+// e.g. v3.5.9, 3.5.9-debian-11-r3
+var versionRe = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)`)
+
+// imageVersion etcd version from the image tag, false for digests and tags like 3 or latest
+func imageVersion(image string) (etcdVersion, bool) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		// no tag, a colon before the last slash is the registry port
+		return etcdVersion{}, false
+	}
+
+	m := versionRe.FindStringSubmatch(image[i+1:])
+	if m == nil {
+		return etcdVersion{}, false
+	}
+
+	var r [3]int
+	for j := range r {
+		r[j], _ = strconv.Atoi(m[j+1])
+	}
+
+	return etcdVersion{Major: r[0], Minor: r[1], Patch: r[2]}, true
+}
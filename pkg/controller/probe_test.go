@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestImageVersion(t *testing.T) {
+	cases := []struct {
+		image string
+		want  etcdVersion
+		ok    bool
+	}{
+		{"quay.io/coreos/etcd:v3.4.13", etcdVersion{3, 4, 13}, true},
+		{"bitnami/etcd:3.5.9-debian-11-r3", etcdVersion{3, 5, 9}, true},
+		{"registry:5000/etcd:3.5.12@sha256:abc", etcdVersion{3, 5, 12}, true},
+		{"bitnami/etcd:3", etcdVersion{}, false},
+		{"registry:5000/etcd", etcdVersion{}, false},
+	}
+
+	for _, c := range cases {
+		v, ok := imageVersion(c.image)
+		require.Equal(t, c.ok, ok, c.image)
+		require.Equal(t, c.want, v, c.image)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Image: "bitnami/etcd:3.5.12",
+			Probes: &dbv1.ProbesSpec{
+				Startup: &dbv1.ProbeTiming{FailureThreshold: 120},
+			},
+		},
+	}
+	b := NewResourceBuilder(cr)
+
+	require.Equal(t, pathReadyz, b.readinessProbe().HTTPGet.Path)
+	require.Equal(t, pathLivez, b.livenessProbe().HTTPGet.Path)
+	require.Equal(t, portMetrics, b.livenessProbe().HTTPGet.Port.IntValue())
+
+	startup := b.startupProbe()
+	require.Equal(t, int32(120), startup.FailureThreshold)
+	require.Equal(t, defaultStartup.PeriodSeconds, startup.PeriodSeconds)
+
+	cr.Spec.Image = "bitnami/etcd:3"
+	require.Equal(t, pathHealthSerializable, b.readinessProbe().HTTPGet.Path)
+	require.Equal(t, pathHealthLive, b.livenessProbe().HTTPGet.Path)
+
+	cr.Spec.Image = "quay.io/coreos/etcd:v3.4.13"
+	require.Equal(t, pathHealth, b.readinessProbe().HTTPGet.Path)
+	require.NotNil(t, b.livenessProbe().TCPSocket)
+}
+
+// members are not ready until a leader is elected, bootstrap must not wait for readiness
+func TestBootstrapWithoutReadyMembers(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+			Image:   "bitnami/etcd:3.5.12",
+		},
+	}
+	b := NewResourceBuilder(cr)
+
+	sts := b.StatefulSet(MemberLabel(cr.ObjectMeta, SelectAll))
+	require.Equal(t, appsv1.ParallelPodManagement, sts.Spec.PodManagementPolicy)
+	require.Equal(t, pathReadyz, sts.Spec.Template.Spec.Containers[0].ReadinessProbe.HTTPGet.Path)
+
+	svc := b.HeadlessService(cr.Name, MemberLabel(cr.ObjectMeta, SelectAll), MemberLabel(cr.ObjectMeta, SelectAll))
+	require.True(t, svc.Spec.PublishNotReadyAddresses)
+}
@@ -4,11 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
+	"path"
 	"strings"
 
 	log "github.com/win5do/go-lib/logx"
 	appv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -21,6 +25,31 @@ const (
 	PortClientName = "client"
 	portClient     = 2379
 	portPeer       = 2380
+
+	// plain http even with TLS on, serves /metrics and the health endpoints
+	PortMetricsName = "metrics"
+	portMetrics     = 2381
+	// https with client cert auth when spec.monitoring.tls is set
+	PortMetricsTLSName = "metrics-tls"
+	portMetricsTLS     = 2382
+
+	dataVolumeName = "data"
+	walVolumeName  = "wal"
+	walMountPath   = "/var/run/etcd-wal"
+
+	// inspect jobs start etcd on a copy of the member data
+	inspectScratchVolumeName = "scratch"
+	inspectScratchDir        = "/var/run/inspect"
+
+	tlsVolumeName       = "tls"
+	tlsMountPath        = "/etc/etcd/tls"
+	clientTLSVolumeName = "client-tls"
+	clientTLSMountPath  = "/etc/etcd/client-tls"
+
+	snapshotDir     = "/snapshot"
+	defaultS3Image  = "amazon/aws-cli"
+	snapshotStorage = "8Gi"
+	snapshotBackoff = 3
 )
 
 var (
@@ -38,12 +67,23 @@ func NewResourceBuilder(cr *dbv1.Etcd) *ResourceBuilder {
 }
 
 func (s *ResourceBuilder) StatefulSet(labels map[string]string) *appv1.StatefulSet {
+	obj := s.statefulSet(labels)
+
+	err := s.overrideStatefulSet(obj)
+	if err != nil {
+		// reported by CheckOverrides
+		log.Errorf("ignore invalid statefulSet override of %s/%s: %v", s.cr.Namespace, s.cr.Name, err)
+	}
+
+	return obj
+}
+
+// statefulSet without spec.overrides
+func (s *ResourceBuilder) statefulSet(labels map[string]string) *appv1.StatefulSet {
 	cr := s.cr
 
 	name := cr.Name
 
-	dataVolumeName := "data"
-
 	replicas := int32(cr.Spec.Members)
 
 	obj := &appv1.StatefulSet{
@@ -58,6 +98,14 @@ func (s *ResourceBuilder) StatefulSet(labels map[string]string) *appv1.StatefulS
 				MatchLabels: labels,
 			},
 			ServiceName: cr.Name,
+			// the readiness probe needs a leader, members must start and resolve each other before any is ready
+			PodManagementPolicy: appv1.ParallelPodManagement,
+			UpdateStrategy: appv1.StatefulSetUpdateStrategy{
+				Type: appv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appv1.RollingUpdateStatefulSetStrategy{
+					Partition: s.partition(),
+				},
+			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: labels,
@@ -66,7 +114,7 @@ func (s *ResourceBuilder) StatefulSet(labels map[string]string) *appv1.StatefulS
 					Containers: []corev1.Container{
 						{
 							Name:            etcd,
-							Image:           cr.Spec.Image,
+							Image:           s.Image(),
 							ImagePullPolicy: cr.Spec.ImagePullPolicy,
 							Env:             s.Env(),
 							Resources: corev1.ResourceRequirements{
@@ -79,26 +127,43 @@ func (s *ResourceBuilder) StatefulSet(labels map[string]string) *appv1.StatefulS
 									MountPath: "/var/run/etcd",
 								},
 							},
-							ReadinessProbe: s.probe(portClient, 0, 10, 10, 3),
-							LivenessProbe:  s.probe(portClient, 180, 10, 30, 10),
+							Ports: []corev1.ContainerPort{
+								{Name: PortClientName, ContainerPort: portClient, Protocol: corev1.ProtocolTCP},
+								{Name: "peer", ContainerPort: portPeer, Protocol: corev1.ProtocolTCP},
+								{Name: PortMetricsName, ContainerPort: portMetrics, Protocol: corev1.ProtocolTCP},
+							},
+							ReadinessProbe: s.readinessProbe(),
+							LivenessProbe:  s.livenessProbe(),
+							StartupProbe:   s.startupProbe(),
 							Command:        s.command(),
 						},
 					},
 					SecurityContext: &corev1.PodSecurityContext{
 						RunAsUser: &sccUser,
 					},
-					ImagePullSecrets:   cr.Spec.ImagePullSecrets,
-					ServiceAccountName: cr.Spec.ServiceAccountName,
-					HostAliases:        cr.Spec.PodSpec.HostAliases,
-					RestartPolicy:      cr.Spec.PodSpec.RestartPolicy,
-					NodeSelector:       cr.Spec.PodSpec.NodeSelector,
-					Affinity:           s.affinity(),
-					Tolerations:        cr.Spec.PodSpec.Tolerations,
+					ImagePullSecrets:          cr.Spec.ImagePullSecrets,
+					ServiceAccountName:        cr.Spec.ServiceAccountName,
+					HostAliases:               cr.Spec.PodSpec.HostAliases,
+					RestartPolicy:             cr.Spec.PodSpec.RestartPolicy,
+					NodeSelector:              cr.Spec.PodSpec.NodeSelector,
+					Affinity:                  s.affinity(),
+					TopologySpreadConstraints: s.topologySpreadConstraints(),
+					Tolerations:               cr.Spec.PodSpec.Tolerations,
 				},
 			},
 		},
 	}
 
+	s.withMetadata(&obj.ObjectMeta, kindStatefulSet, member)
+	s.withMetadata(&obj.Spec.Template.ObjectMeta, kindPod, member)
+
+	if cr.MetricsTLS() {
+		container := &obj.Spec.Template.Spec.Containers[0]
+		container.Ports = append(container.Ports, corev1.ContainerPort{
+			Name: PortMetricsTLSName, ContainerPort: portMetricsTLS, Protocol: corev1.ProtocolTCP,
+		})
+	}
+
 	volumes := make([]corev1.Volume, 0)
 
 	// 是否需要数据持久化
@@ -125,38 +190,132 @@ func (s *ResourceBuilder) StatefulSet(labels map[string]string) *appv1.StatefulS
 		}
 	}
 
-	obj.Spec.Template.Spec.Volumes = volumes
+	// wal 使用单独的 PVC，可以放到更快的 StorageClass 上
+	if wal := cr.Spec.WalStorage; wal != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: walVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: walVolumeName,
+				},
+			},
+		})
 
-	obj.Annotations = map[string]string{
-		SpecHash: hashStr(obj.Spec),
+		container := &obj.Spec.Template.Spec.Containers[0]
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      walVolumeName,
+			MountPath: walMountPath,
+		})
+
+		obj.Spec.VolumeClaimTemplates = append(obj.Spec.VolumeClaimTemplates,
+			*s.pvc(walVolumeName, wal.Size, wal.StorageClassName))
+	}
+
+	if cr.TLSEnabled() {
+		volumes = append(volumes, s.secretVolume(tlsVolumeName, cr.ServerTLSSecretName()))
+
+		container := &obj.Spec.Template.Spec.Containers[0]
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      tlsVolumeName,
+			MountPath: tlsMountPath,
+			ReadOnly:  true,
+		})
 	}
 
+	obj.Spec.Template.Spec.Volumes = volumes
+
 	return obj
 }
 
+// Image is the image members should run, it only differs from spec.image during an upgrade
+func (s *ResourceBuilder) Image() string {
+	st := s.cr.Status
+
+	if st.Upgrade != nil {
+		if st.Upgrade.Phase == dbv1.UpgradePhaseUpgrading {
+			return st.Upgrade.ToImage
+		}
+		return st.Upgrade.FromImage
+	}
+
+	if st.Image != "" {
+		return st.Image
+	}
+
+	return s.cr.Spec.Image
+}
+
+func (s *ResourceBuilder) partition() *int32 {
+	var r int32
+
+	if up := s.cr.Status.Upgrade; up != nil && up.Phase == dbv1.UpgradePhaseUpgrading {
+		r = up.Partition
+	}
+
+	return &r
+}
+
 // Ref: https://github.com/rustudorcalin/deploying-etcd-cluster
 const etcdCmdTpl = `
 SERVICE=%s
 PEERS="%s"
+SCHEME=%s
 exec etcd --name ${HOSTNAME} \
---listen-client-urls http://0.0.0.0:2379 \
+--listen-client-urls ${SCHEME}://0.0.0.0:2379 \
 --listen-peer-urls http://0.0.0.0:2380 \
---advertise-client-urls http://${HOSTNAME}.${SERVICE}:2379 \
+--listen-metrics-urls %s \
+--advertise-client-urls ${SCHEME}://${HOSTNAME}.${SERVICE}:2379 \
 --initial-advertise-peer-urls http://${HOSTNAME}.${SERVICE}:2380 \
 --initial-cluster-token ${SERVICE} \
 --initial-cluster ${PEERS} \
 --initial-cluster-state new \
---data-dir /var/run/etcd/default.etcd
+--data-dir /var/run/etcd/default.etcd%s
 `
 
+// metricsURLs the http listener is always there for the probes
+func (s *ResourceBuilder) metricsURLs() string {
+	r := fmt.Sprintf("http://0.0.0.0:%d", portMetrics)
+	if s.cr.MetricsTLS() {
+		r += fmt.Sprintf(",https://0.0.0.0:%d", portMetricsTLS)
+	}
+
+	return r
+}
+
 func (s *ResourceBuilder) command() []string {
 	return []string{
 		"sh",
 		"-c",
-		fmt.Sprintf(etcdCmdTpl, s.cr.Name, innerAddr(s.cr)),
+		fmt.Sprintf(etcdCmdTpl, s.cr.Name, innerAddr(s.cr), scheme(s.cr), s.metricsURLs(), s.extraFlags()),
 	}
 }
 
+// extraFlags optional etcd flags, appended to the command one per line
+func (s *ResourceBuilder) extraFlags() string {
+	var flags []string
+
+	if s.cr.Spec.WalStorage != nil {
+		flags = append(flags, "--wal-dir "+path.Join(walMountPath, "default.wal"))
+	}
+
+	if s.cr.TLSEnabled() {
+		flags = append(flags,
+			"--cert-file "+path.Join(tlsMountPath, corev1.TLSCertKey),
+			"--key-file "+path.Join(tlsMountPath, corev1.TLSPrivateKeyKey),
+			"--trusted-ca-file "+path.Join(tlsMountPath, CACertKey),
+			"--client-cert-auth",
+		)
+	}
+
+	var r strings.Builder
+	for _, f := range flags {
+		r.WriteString(" \\\n")
+		r.WriteString(f)
+	}
+
+	return r.String()
+}
+
 func (s *ResourceBuilder) resourceQuota(cpu, memory string) corev1.ResourceList {
 	cr := s.cr
 
@@ -213,6 +372,11 @@ func (s *ResourceBuilder) setEnvVar(fields []string) []corev1.EnvVar {
 }
 
 func (s *ResourceBuilder) HeadlessService(name string, labels, selector map[string]string) *corev1.Service {
+	return s.finishService(s.headlessService(name, labels, selector))
+}
+
+// headlessService without spec.overrides
+func (s *ResourceBuilder) headlessService(name string, labels, selector map[string]string) *corev1.Service {
 	cr := s.cr
 
 	svc := &corev1.Service{
@@ -224,49 +388,231 @@ func (s *ResourceBuilder) HeadlessService(name string, labels, selector map[stri
 		Spec: corev1.ServiceSpec{
 			Ports: []corev1.ServicePort{
 				{
-					Port:     portClient,
-					Name:     PortClientName,
-					Protocol: corev1.ProtocolTCP,
+					Port:       portClient,
+					Name:       PortClientName,
+					TargetPort: intstr.FromInt(portClient),
+					Protocol:   corev1.ProtocolTCP,
 				},
 				{
-					Port:     portPeer,
-					Name:     "peer",
-					Protocol: corev1.ProtocolTCP,
+					Port:       portPeer,
+					Name:       "peer",
+					TargetPort: intstr.FromInt(portPeer),
+					Protocol:   corev1.ProtocolTCP,
 				},
+				s.metricsServicePort(),
 			},
 			Selector:  selector,
 			ClusterIP: corev1.ClusterIPNone,
+			Type:      corev1.ServiceTypeClusterIP,
+			// peers are resolved before they are ready, otherwise bootstrap never elects a leader
+			PublishNotReadyAddresses: true,
 		},
 	}
+	s.withMetadata(&svc.ObjectMeta, kindService, member)
 
 	return svc
 }
 
-func (s *ResourceBuilder) ExportService(name string, labels, selector map[string]string) *corev1.Service {
+func (s *ResourceBuilder) ExportService(name string, svcType corev1.ServiceType, labels, selector map[string]string) *corev1.Service {
 	cr := s.cr
 
+	var annotations map[string]string
+	if cr.Spec.Service != nil {
+		annotations = cr.Spec.Service.Annotations
+	}
+
 	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: cr.Namespace,
-			Labels:    labels,
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: corev1.ServiceSpec{
 			Ports: []corev1.ServicePort{
 				{
-					Port:     portClient,
-					Name:     PortClientName,
-					Protocol: corev1.ProtocolTCP,
+					Port:       portClient,
+					Name:       PortClientName,
+					TargetPort: intstr.FromInt(portClient),
+					Protocol:   corev1.ProtocolTCP,
 				},
 			},
 			Selector: selector,
-			Type:     corev1.ServiceTypeNodePort,
+			Type:     svcType,
 		},
 	}
+	s.withMetadata(&svc.ObjectMeta, kindService, Client)
+
+	return s.finishService(svc)
+}
+
+func (s *ResourceBuilder) finishService(svc *corev1.Service) *corev1.Service {
+	err := s.overrideService(svc)
+	if err != nil {
+		// reported by CheckOverrides
+		log.Errorf("ignore invalid services override of %s/%s: %v", s.cr.Namespace, s.cr.Name, err)
+	}
 
 	return svc
 }
 
+// NetworkPolicy peer port only between members, client port from allowed clients, the members, their jobs and the operator,
+// metrics ports from allowed scrapers
+func (s *ResourceBuilder) NetworkPolicy(name string, labels map[string]string) *networkingv1.NetworkPolicy {
+	cr := s.cr
+
+	tcp := corev1.ProtocolTCP
+	client := intstr.FromInt(portClient)
+	peer := intstr.FromInt(portPeer)
+
+	clients := []networkingv1.NetworkPolicyPeer{
+		{
+			// members and job pods
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					LabelCrName: cr.Name,
+					LabelCrUID:  string(cr.UID),
+				},
+			},
+		},
+		{
+			// the operator, see config/manager/manager.yaml
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: operatorNamespaceLabel()},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: operatorLabel()},
+		},
+	}
+	if cr.Spec.NetworkPolicy != nil {
+		clients = append(clients, cr.Spec.NetworkPolicy.AllowedClients...)
+	}
+
+	obj := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: MemberLabel(cr.ObjectMeta, SelectAll),
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &peer}},
+					From: []networkingv1.NetworkPolicyPeer{
+						{
+							PodSelector: &metav1.LabelSelector{
+								MatchLabels: MemberLabel(cr.ObjectMeta, SelectAll),
+							},
+						},
+					},
+				},
+				{
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &client}},
+					From:  clients,
+				},
+			},
+		},
+	}
+
+	// no rule would mean every source, so the metrics ports stay closed without scrapers
+	if cr.Spec.NetworkPolicy != nil && len(cr.Spec.NetworkPolicy.AllowedScrapers) > 0 {
+		metrics := intstr.FromInt(portMetrics)
+		metricsTLS := intstr.FromInt(portMetricsTLS)
+		obj.Spec.Ingress = append(obj.Spec.Ingress, networkingv1.NetworkPolicyIngressRule{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &metrics}, {Protocol: &tcp, Port: &metricsTLS}},
+			From:  cr.Spec.NetworkPolicy.AllowedScrapers,
+		})
+	}
+
+	s.withMetadata(&obj.ObjectMeta, kindOther, member)
+
+	return obj
+}
+
+// PodDisruptionBudget lets evictions take members down only while a quorum stays up
+func (s *ResourceBuilder) PodDisruptionBudget(name string, labels map[string]string) *policyv1beta1.PodDisruptionBudget {
+	cr := s.cr
+
+	maxUnavailable := intstr.FromInt(maxUnavailable(cr.Spec.Members))
+
+	obj := &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: MemberLabel(cr.ObjectMeta, SelectAll),
+			},
+		},
+	}
+
+	s.withMetadata(&obj.ObjectMeta, kindOther, member)
+
+	return obj
+}
+
+// maxUnavailable members minus quorum, at least 1 so drains are never blocked for good
+func maxUnavailable(members int) int {
+	r := members - (members/2 + 1)
+	if r < 1 {
+		return 1
+	}
+
+	return r
+}
+
+func (s *ResourceBuilder) secretVolume(name, secretName string) corev1.Volume {
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secretName,
+			},
+		},
+	}
+}
+
+// EtcdctlEnv configures etcdctl for the cluster, the client cert is expected at clientTLSMountPath
+func (s *ResourceBuilder) EtcdctlEnv() []corev1.EnvVar {
+	cr := s.cr
+
+	r := []corev1.EnvVar{
+		{
+			Name:  "ETCDCTL_API",
+			Value: "3",
+		},
+	}
+
+	if cr.TLSEnabled() {
+		r = append(r,
+			corev1.EnvVar{Name: "ETCDCTL_CACERT", Value: path.Join(clientTLSMountPath, CACertKey)},
+			corev1.EnvVar{Name: "ETCDCTL_CERT", Value: path.Join(clientTLSMountPath, corev1.TLSCertKey)},
+			corev1.EnvVar{Name: "ETCDCTL_KEY", Value: path.Join(clientTLSMountPath, corev1.TLSPrivateKeyKey)},
+		)
+	}
+
+	if cr.AuthEnabled() {
+		r = append(r,
+			corev1.EnvVar{Name: "ETCDCTL_USER", Value: rootUser},
+			corev1.EnvVar{
+				Name: "ETCDCTL_PASSWORD",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: cr.AuthSecretName()},
+						Key:                  corev1.BasicAuthPasswordKey,
+					},
+				},
+			},
+		)
+	}
+
+	return r
+}
+
 func (s *ResourceBuilder) EmptyDirVolume(name string) corev1.Volume {
 	return corev1.Volume{
 		Name: name,
@@ -277,15 +623,19 @@ func (s *ResourceBuilder) EmptyDirVolume(name string) corev1.Volume {
 }
 
 func (s *ResourceBuilder) PVC(name, storage string) *corev1.PersistentVolumeClaim {
+	return s.pvc(name, storage, s.cr.Spec.StorageClassName)
+}
+
+func (s *ResourceBuilder) pvc(name, storage, storageClass string) *corev1.PersistentVolumeClaim {
 	cr := s.cr
 
 	var storageClassName *string
-	if cr.Spec.StorageClassName != "" {
-		log.Debugf("PVC storageClassName: %s", cr.Spec.StorageClassName)
-		storageClassName = &cr.Spec.StorageClassName
+	if storageClass != "" {
+		log.Debugf("PVC storageClassName: %s", storageClass)
+		storageClassName = &storageClass
 	}
 
-	return &corev1.PersistentVolumeClaim{
+	obj := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: cr.Namespace,
@@ -303,48 +653,323 @@ func (s *ResourceBuilder) PVC(name, storage string) *corev1.PersistentVolumeClai
 			},
 		},
 	}
+	s.withMetadata(&obj.ObjectMeta, kindPVC, "")
+
+	return obj
 }
 
-func (s *ResourceBuilder) probe(port int, init, timeout, period, failure int32) *corev1.Probe {
-	r := &corev1.Probe{}
+func (s *ResourceBuilder) SnapshotJob(name, file string, dest *dbv1.SnapshotDestination) *batchv1.Job {
+	cr := s.cr
+
+	snapshotVolumeName := "snapshot"
+	backoffLimit := int32(snapshotBackoff)
 
-	r.TCPSocket = &corev1.TCPSocketAction{
-		Port: intstr.FromInt(port),
+	save := corev1.Container{
+		Name:            "save",
+		Image:           s.Image(),
+		ImagePullPolicy: cr.Spec.ImagePullPolicy,
+		Command: []string{
+			"etcdctl",
+			"--endpoints", clientSvcEndpoint(cr),
+			"snapshot", "save", path.Join(snapshotDir, file),
+		},
+		Env: s.EtcdctlEnv(),
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      snapshotVolumeName,
+				MountPath: snapshotDir,
+			},
+		},
+	}
+
+	var volumes []corev1.Volume
+	if cr.TLSEnabled() {
+		volumes = append(volumes, s.secretVolume(clientTLSVolumeName, cr.ClientTLSSecretName()))
+		save.VolumeMounts = append(save.VolumeMounts, corev1.VolumeMount{
+			Name:      clientTLSVolumeName,
+			MountPath: clientTLSMountPath,
+			ReadOnly:  true,
+		})
 	}
 
-	r.InitialDelaySeconds = init
-	r.TimeoutSeconds = timeout
-	r.PeriodSeconds = period
-	r.FailureThreshold = failure
+	podSpec := corev1.PodSpec{
+		RestartPolicy: corev1.RestartPolicyNever,
+		SecurityContext: &corev1.PodSecurityContext{
+			RunAsUser: &sccUser,
+		},
+		ImagePullSecrets:   cr.Spec.ImagePullSecrets,
+		ServiceAccountName: cr.Spec.ServiceAccountName,
+		NodeSelector:       cr.Spec.PodSpec.NodeSelector,
+		Tolerations:        cr.Spec.PodSpec.Tolerations,
+	}
 
-	return r
+	if dest.PVC != nil {
+		podSpec.Containers = []corev1.Container{save}
+		podSpec.Volumes = append(volumes, corev1.Volume{
+			Name: snapshotVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: dest.PVC.ClaimName,
+				},
+			},
+		})
+	} else {
+		// save to a scratch volume, then upload
+		podSpec.InitContainers = []corev1.Container{save}
+		podSpec.Containers = []corev1.Container{s.s3Upload(file, snapshotVolumeName, dest.S3)}
+		podSpec.Volumes = append(volumes, s.EmptyDirVolume(snapshotVolumeName))
+	}
+
+	obj := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    jobLabel(cr.ObjectMeta, snapshot),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: jobPodLabel(cr.ObjectMeta, snapshot),
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+
+	return s.jobMetadata(obj, snapshot)
 }
 
-func (s *ResourceBuilder) affinity() *corev1.Affinity {
-	if s.cr.Spec.PodSpec.Affinity != nil {
-		return s.cr.Spec.PodSpec.Affinity
+// starts the member alone on a copy of its data and records its status as termination message,
+// etcd writes to the wal and db on start, the claims are mounted read only
+const inspectCmdTpl = `
+set -e
+cp -a /var/run/etcd/default.etcd %[2]s/default.etcd%[3]s
+etcd --name %[1]s \
+--listen-client-urls http://127.0.0.1:2379 \
+--advertise-client-urls http://127.0.0.1:2379 \
+--listen-peer-urls http://127.0.0.1:2380 \
+--data-dir %[2]s/default.etcd%[4]s >/dev/null 2>&1 &
+PID=$!
+for i in $(seq 30); do
+  if etcdctl --endpoints 127.0.0.1:2379 endpoint status -w json > /dev/termination-log; then
+    kill $PID
+    exit 0
+  fi
+  sleep 2
+done
+kill $PID
+exit 1
+`
+
+// InspectJob reads the cluster ID from a copy of the data of member id, the data is left untouched
+func (s *ResourceBuilder) InspectJob(name string, id int) *batchv1.Job {
+	cr := s.cr
+
+	backoffLimit := int32(0)
+	member := podName(cr.Name, id)
+
+	var walCopy, walFlag string
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      dataVolumeName,
+			MountPath: "/var/run/etcd",
+			ReadOnly:  true,
+		},
+		{
+			Name:      inspectScratchVolumeName,
+			MountPath: inspectScratchDir,
+		},
+	}
+	volumes := []corev1.Volume{
+		s.EmptyDirVolume(inspectScratchVolumeName),
+		{
+			Name: dataVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: AddSuffix(dataVolumeName, member),
+				},
+			},
+		},
 	}
 
-	// 反亲和性配置，让pod最好不要分配到同一node上
-	podAntiAffinity := &corev1.PodAntiAffinity{
-		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
-			{
-				Weight: 50,
-				PodAffinityTerm: corev1.PodAffinityTerm{
-					LabelSelector: &metav1.LabelSelector{
-						MatchLabels: MemberLabel(s.cr.ObjectMeta, SelectAll),
+	if cr.Spec.WalStorage != nil {
+		walCopy = fmt.Sprintf("\ncp -a %s %s", path.Join(walMountPath, "default.wal"), path.Join(inspectScratchDir, "default.wal"))
+		walFlag = " \\\n--wal-dir " + path.Join(inspectScratchDir, "default.wal")
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      walVolumeName,
+			MountPath: walMountPath,
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, corev1.Volume{
+			Name: walVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: AddSuffix(walVolumeName, member),
+				},
+			},
+		})
+	}
+
+	obj := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    jobLabel(cr.ObjectMeta, inspect),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: jobPodLabel(cr.ObjectMeta, inspect),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:            inspect,
+							Image:           s.Image(),
+							ImagePullPolicy: cr.Spec.ImagePullPolicy,
+							Command: []string{
+								"sh",
+								"-c",
+								fmt.Sprintf(inspectCmdTpl, member, inspectScratchDir, walCopy, walFlag),
+							},
+							Env: []corev1.EnvVar{
+								{
+									Name:  "ETCDCTL_API",
+									Value: "3",
+								},
+							},
+							VolumeMounts: mounts,
+						},
 					},
-					TopologyKey: "kubernetes.io/hostname", // 此node label key默认存在
+					SecurityContext: &corev1.PodSecurityContext{
+						RunAsUser: &sccUser,
+					},
+					ImagePullSecrets:   cr.Spec.ImagePullSecrets,
+					ServiceAccountName: cr.Spec.ServiceAccountName,
+					NodeSelector:       cr.Spec.PodSpec.NodeSelector,
+					Tolerations:        cr.Spec.PodSpec.Tolerations,
+					Volumes:            volumes,
 				},
 			},
 		},
 	}
 
+	return s.jobMetadata(obj, inspect)
+}
+
+func (s *ResourceBuilder) s3Upload(file, volumeName string, dest *dbv1.S3Destination) corev1.Container {
+	image := dest.Image
+	if image == "" {
+		image = defaultS3Image
+	}
+
+	args := []string{
+		"s3", "cp",
+		path.Join(snapshotDir, file),
+		fmt.Sprintf("s3://%s/%s", dest.Bucket, path.Join(dest.Prefix, file)),
+	}
+	if dest.Endpoint != "" {
+		args = append(args, "--endpoint-url", dest.Endpoint)
+	}
+	if dest.Region != "" {
+		args = append(args, "--region", dest.Region)
+	}
+
+	c := corev1.Container{
+		Name:  "upload",
+		Image: image,
+		Args:  args,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      volumeName,
+				MountPath: snapshotDir,
+				ReadOnly:  true,
+			},
+		},
+	}
+
+	if dest.CredentialsSecret != "" {
+		c.EnvFrom = []corev1.EnvFromSource{
+			{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: dest.CredentialsSecret,
+					},
+				},
+			},
+		}
+	}
+
+	return c
+}
+
+func (s *ResourceBuilder) affinity() *corev1.Affinity {
+	if s.cr.Spec.PodSpec.Affinity != nil {
+		return s.cr.Spec.PodSpec.Affinity
+	}
+
+	mode := dbv1.PlacementPreferred
+	keys := []string{dbv1.TopologyKeyHostname} // 此node label key默认存在
+	if p := s.cr.Spec.Placement; p != nil {
+		if p.Mode != "" {
+			mode = p.Mode
+		}
+		if len(p.TopologyKeys) > 0 {
+			keys = p.TopologyKeys
+		}
+	}
+
+	// 反亲和性配置，让pod不要分配到同一 node/zone 上
+	podAntiAffinity := &corev1.PodAntiAffinity{}
+	for _, key := range keys {
+		term := corev1.PodAffinityTerm{
+			LabelSelector: &metav1.LabelSelector{
+				MatchLabels: MemberLabel(s.cr.ObjectMeta, SelectAll),
+			},
+			TopologyKey: key,
+		}
+
+		if mode == dbv1.PlacementRequired {
+			podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(
+				podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, term)
+			continue
+		}
+
+		podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+			podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, corev1.WeightedPodAffinityTerm{
+				Weight:          50,
+				PodAffinityTerm: term,
+			})
+	}
+
 	return &corev1.Affinity{
 		PodAntiAffinity: podAntiAffinity,
 	}
 }
 
+func (s *ResourceBuilder) topologySpreadConstraints() []corev1.TopologySpreadConstraint {
+	p := s.cr.Spec.Placement
+	if p == nil {
+		return nil
+	}
+
+	var r []corev1.TopologySpreadConstraint
+	for _, v := range p.TopologySpreadConstraints {
+		c := *v.DeepCopy()
+		if c.LabelSelector == nil {
+			c.LabelSelector = &metav1.LabelSelector{
+				MatchLabels: MemberLabel(s.cr.ObjectMeta, SelectAll),
+			}
+		}
+		r = append(r, c)
+	}
+
+	return r
+}
+
 func innerAddr(cr *dbv1.Etcd) string {
 	var r strings.Builder
 	const peer = "${pod-name}=http://${pod-name}.${svc-name}:2380"
@@ -363,6 +988,41 @@ func innerAddr(cr *dbv1.Etcd) string {
 	return r.String()
 }
 
+// memberEndpoints client url of every member, reachable from the operator
+func memberEndpoints(cr *dbv1.Etcd) []string {
+	var r []string
+
+	for _, v := range memberAddrs(cr) {
+		r = append(r, scheme(cr)+"://"+v)
+	}
+
+	return r
+}
+
+// memberAddrs host:port of every member through the headless service
+func memberAddrs(cr *dbv1.Etcd) []string {
+	var r []string
+
+	for i := 0; i < cr.Spec.Members; i++ {
+		r = append(r, fmt.Sprintf("%s.%s.%s.svc:%d", podName(cr.Name, i), cr.Name, cr.Namespace, portClient))
+	}
+
+	return r
+}
+
+// clientSvcEndpoint client url resolving to any ready member
+func clientSvcEndpoint(cr *dbv1.Etcd) string {
+	return fmt.Sprintf("%s://%s.%s.svc:%d", scheme(cr), cr.Name, cr.Namespace, portClient)
+}
+
+func scheme(cr *dbv1.Etcd) string {
+	if cr.TLSEnabled() {
+		return "https"
+	}
+
+	return "http"
+}
+
 func hashStr(data interface{}) string {
 	hf := fnv.New32()
 
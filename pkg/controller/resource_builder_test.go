@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+func TestAffinity(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+		},
+	}
+
+	a := NewResourceBuilder(cr).affinity().PodAntiAffinity
+	require.Len(t, a.PreferredDuringSchedulingIgnoredDuringExecution, 1)
+	require.Equal(t, dbv1.TopologyKeyHostname, a.PreferredDuringSchedulingIgnoredDuringExecution[0].PodAffinityTerm.TopologyKey)
+
+	cr.Spec.Placement = &dbv1.Placement{
+		Mode:         dbv1.PlacementRequired,
+		TopologyKeys: []string{dbv1.TopologyKeyHostname, dbv1.TopologyKeyZone},
+		TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+			{MaxSkew: 1, TopologyKey: dbv1.TopologyKeyZone, WhenUnsatisfiable: corev1.DoNotSchedule},
+		},
+	}
+
+	a = NewResourceBuilder(cr).affinity().PodAntiAffinity
+	require.Empty(t, a.PreferredDuringSchedulingIgnoredDuringExecution)
+	require.Len(t, a.RequiredDuringSchedulingIgnoredDuringExecution, 2)
+
+	tsc := NewResourceBuilder(cr).topologySpreadConstraints()
+	require.Equal(t, MemberLabel(cr.ObjectMeta, SelectAll), tsc[0].LabelSelector.MatchLabels)
+	require.Nil(t, cr.Spec.Placement.TopologySpreadConstraints[0].LabelSelector)
+}
+
+func TestOverrideStatefulSet(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+			Image:   "etcd:3.5",
+			Overrides: &dbv1.Overrides{
+				StatefulSet: &runtime.RawExtension{Raw: []byte(`{
+					"spec": {
+						"replicas": 1,
+						"template": {
+							"metadata": {"labels": {"role": "other", "team": "a"}},
+							"spec": {
+								"priorityClassName": "high",
+								"containers": [
+									{"name": "etcd", "image": "other", "env": [{"name": "FOO", "value": "bar"}]},
+									{"name": "sidecar", "image": "busybox"}
+								]
+							}
+						}
+					}
+				}`)},
+				Services: &runtime.RawExtension{Raw: []byte(`{"metadata": {"annotations": {"team": "a"}}, "spec": {"type": "NodePort"}}`)},
+			},
+		},
+	}
+
+	b := NewResourceBuilder(cr)
+	plain := *cr
+	plain.Spec.Overrides = nil
+
+	sts := b.StatefulSet(MemberLabel(cr.ObjectMeta, SelectAll))
+	require.Equal(t, int32(3), *sts.Spec.Replicas)
+	require.Equal(t, "high", sts.Spec.Template.Spec.PriorityClassName)
+	require.Equal(t, "a", sts.Spec.Template.Labels["team"])
+	require.Equal(t, etcd, sts.Spec.Template.Labels[labelRole])
+
+	containers := sts.Spec.Template.Spec.Containers
+	require.Len(t, containers, 2)
+	require.Equal(t, "etcd:3.5", containers[0].Image)
+	require.Contains(t, containers[0].Env, corev1.EnvVar{Name: "FOO", Value: "bar"})
+	require.NotEqual(t, NewResourceBuilder(&plain).StatefulSet(MemberLabel(cr.ObjectMeta, SelectAll)).Spec, sts.Spec)
+
+	svc := b.HeadlessService("foo", MemberLabel(cr.ObjectMeta, SelectAll), MemberLabel(cr.ObjectMeta, SelectAll))
+	require.Equal(t, corev1.ServiceTypeClusterIP, svc.Spec.Type)
+	require.Equal(t, corev1.ClusterIPNone, svc.Spec.ClusterIP)
+	require.Equal(t, "a", svc.Annotations["team"])
+	require.Len(t, svc.Spec.Ports, 3)
+}
+
+func TestOverrideKeepsMember(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 3,
+			Storage: "1Gi",
+			TLS:     &dbv1.TLSSpec{Enabled: true},
+		},
+	}
+	plain := NewResourceBuilder(cr.DeepCopy())
+
+	cases := []struct {
+		sts, svc string
+	}{
+		{sts: `{"spec": {"template": {"spec": {"containers": null}}}}`},
+		{sts: `{"spec": {"template": {"spec": {"volumes": null}}}}`},
+		{sts: `{"spec": {"template": {"spec": {"volumes": [{"name": "data", "emptyDir": {}}]}}}}`},
+		{sts: `{"spec": {"template": {"spec": {"containers": [{"name": "etcd", "volumeMounts": null}]}}}}`},
+		{sts: `{"spec": {"template": {"spec": {"containers": [{"name": "etcd", "ports": [{"containerPort": 2379, "name": "other"}]}]}}}}`},
+		{sts: `{"spec": {"template": {"spec": {"containers": [{"name": "etcd", "$patch": "delete"}]}}}}`},
+		{svc: `{"spec": {"ports": null}}`},
+		{svc: `{"spec": {"ports": [{"port": 2380, "targetPort": 9999}]}}`},
+	}
+
+	for _, c := range cases {
+		cr.Spec.Overrides = &dbv1.Overrides{}
+		if c.sts != "" {
+			cr.Spec.Overrides.StatefulSet = &runtime.RawExtension{Raw: []byte(c.sts)}
+		}
+		if c.svc != "" {
+			cr.Spec.Overrides.Services = &runtime.RawExtension{Raw: []byte(c.svc)}
+		}
+		ct := &controller{cr: cr, Builder: NewResourceBuilder(cr)}
+
+		err := ct.CheckOverrides()
+		require.True(t, errors.Is(err, rerr.Err_invalid_spec), c)
+
+		// never applied
+		labels := MemberLabel(cr.ObjectMeta, SelectAll)
+		require.Equal(t, plain.StatefulSet(labels).Spec, ct.Builder.StatefulSet(labels).Spec, c)
+		require.Equal(t, plain.HeadlessService("foo", labels, labels).Spec, ct.Builder.HeadlessService("foo", labels, labels).Spec, c)
+	}
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	errors2 "github.com/pkg/errors"
+	"github.com/win5do/go-lib/errx"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrlcli "sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+// EnsureSnapshot creates the snapshot job if missing and reports whether it has succeeded,
+// purpose is kept in a label so the jobs of a step can be cleaned up
+func (s *controller) EnsureSnapshot(name, purpose string, dest *dbv1.SnapshotDestination) (bool, error) {
+	job := s.Builder.SnapshotJob(name, name+".db", dest)
+	job.Labels = MergeLabels(job.Labels, map[string]string{labelSnapshotFor: purpose})
+
+	ensure := s.Kcli.Ensure
+	if purpose == snapshotFinal {
+		// not owned by the cluster being deleted, GC would remove the job before the snapshot is taken
+		ensure = s.Kcli.EnsureOrphan
+	}
+
+	found := &batchv1.Job{}
+	err := ensure(s.ctx, job, found)
+	if err != nil {
+		return false, errx.WithStackOnce(err)
+	}
+
+	if found.UID == "" {
+		// just created
+		return false, nil
+	}
+
+	if found.Status.Succeeded > 0 {
+		s.recordSnapshot(found)
+		return true, nil
+	}
+
+	if found.Spec.BackoffLimit != nil && found.Status.Failed > *found.Spec.BackoffLimit {
+		return false, errors2.Errorf("snapshot job %s failed", name)
+	}
+
+	return false, nil
+}
+
+// recordSnapshot the jobs are deleted once their step is done, status keeps when the last one succeeded
+func (s *controller) recordSnapshot(job *batchv1.Job) {
+	cr := s.cr
+
+	t := metav1.Now()
+	if job.Status.CompletionTime != nil {
+		t = *job.Status.CompletionTime
+	}
+
+	if last := cr.Status.LastSnapshotTime; last != nil && !last.Before(&t) {
+		return
+	}
+
+	cr.Status.LastSnapshotTime = &t
+	s.writeStatus()
+}
+
+// deleteSnapshotJobs removes the snapshot jobs taken for purpose, the snapshots themselves are kept
+func (s *controller) deleteSnapshotJobs(purpose string) error {
+	cr := s.cr
+
+	labels := MergeLabels(jobLabel(cr.ObjectMeta, snapshot), map[string]string{labelSnapshotFor: purpose})
+	err := s.Kcli.DeleteALLByLabel(s.ctx, &batchv1.Job{}, cr.Namespace, labels,
+		ctrlcli.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+// defaultSnapshotDestination a PVC managed by the operator. It is not owned by the cluster so GC keeps it
+// with the snapshots, cleanup removes it under the Delete policy only
+func (s *controller) defaultSnapshotDestination() (*dbv1.SnapshotDestination, error) {
+	cr := s.cr
+
+	storage := cr.Spec.Storage
+	if storage == "" {
+		storage = snapshotStorage
+	}
+
+	name := snapshotClaimName(cr)
+	found := &corev1.PersistentVolumeClaim{}
+	err := s.Kcli.EnsureOrphan(s.ctx, s.Builder.PVC(name, storage), found)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	// created owned by the cluster by earlier versions
+	if metav1.IsControlledBy(found, cr) {
+		err := s.Kcli.UpdateObject(s.ctx, found, func() error {
+			found.OwnerReferences = nil
+			return nil
+		})
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+	}
+
+	return &dbv1.SnapshotDestination{
+		PVC: &dbv1.PVCDestination{
+			ClaimName: name,
+		},
+	}, nil
+}
+
+func snapshotClaimName(cr *dbv1.Etcd) string {
+	return AddSuffix(cr.Name, snapshot)
+}
@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestRecordSnapshot(t *testing.T) {
+	cr := testEtcd(1)
+	cr.UID = "uid-1"
+	dest := &dbv1.SnapshotDestination{PVC: &dbv1.PVCDestination{ClaimName: "backup"}}
+
+	done := metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	job := NewResourceBuilder(cr).SnapshotJob("foo-upgrade", "foo-upgrade.db", dest)
+	job.UID = "job-1"
+	job.Status = batchv1.JobStatus{Succeeded: 1, CompletionTime: &done}
+	ct, _ := newFakeController(t, cr, job)
+
+	ok, err := ct.EnsureSnapshot("foo-upgrade", snapshotUpgrade, dest)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NotNil(t, cr.Status.LastSnapshotTime)
+	require.True(t, done.Equal(cr.Status.LastSnapshotTime))
+
+	// an older job does not move it back
+	later := metav1.NewTime(done.Add(time.Minute))
+	cr.Status.LastSnapshotTime = &later
+	_, err = ct.EnsureSnapshot("foo-upgrade", snapshotUpgrade, dest)
+	require.NoError(t, err)
+	require.True(t, later.Equal(cr.Status.LastSnapshotTime))
+}
@@ -1,10 +1,16 @@
 package controller
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/win5do/go-lib/errx"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	dbv1 "github.com/win5do/etcd-operator/api/v1"
@@ -14,11 +20,14 @@ import (
 
 type statusManager struct {
 	kcli *k8s.Kcli
+
+	// status changed by the reconcile and not written yet
+	pending bool
 }
 
-func (s *statusManager) CheckDeployReady(meta metav1.ObjectMeta) (dbv1.NodeStatus, error) {
+func (s *statusManager) CheckDeployReady(ctx context.Context, meta metav1.ObjectMeta) (dbv1.NodeStatus, error) {
 	list := &appsv1.StatefulSetList{}
-	err := s.kcli.ListByLabel(meta.Namespace, MemberLabel(meta, SelectAll), list)
+	err := s.kcli.ListByLabel(ctx, meta.Namespace, MemberLabel(meta, SelectAll), list)
 	if err != nil {
 		return dbv1.StatusUnknown, errx.WithStackOnce(err)
 	}
@@ -45,26 +54,62 @@ func (s *statusManager) CheckDeployReady(meta metav1.ObjectMeta) (dbv1.NodeStatu
 	return status, nil
 }
 
-func (s *statusManager) UpdateStatus(cr *dbv1.Etcd, status dbv1.EtcdStatus) error {
+// UpdateStatus sets the status, all updates of a reconcile are written at once by Flush
+func (s *statusManager) UpdateStatus(cr *dbv1.Etcd, status dbv1.EtcdStatus) {
 	cr.Status = status
+	s.pending = true
+}
+
+// Flush writes the pending status, only fields changed since it was read are patched
+func (s *statusManager) Flush(ctx context.Context, cr *dbv1.Etcd) error {
+	if !s.pending {
+		return nil
+	}
 
-	return s.kcli.WriteStatus(cr)
+	err := s.kcli.WriteStatus(ctx, cr)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	s.pending = false
+	return nil
 }
 
-func (s *statusManager) HandleStatus(cr *dbv1.Etcd, nodePorts []int32) error {
-	status, err := s.CheckDeployReady(cr.ObjectMeta)
+func (s *statusManager) HandleStatus(ctx context.Context, cr *dbv1.Etcd, addrs []string) error {
+	status, err := s.CheckDeployReady(ctx, cr.ObjectMeta)
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
 
-	err = s.UpdateStatus(cr, dbv1.EtcdStatus{
-		Status:      status,
-		ConnectAddr: externalConnectAddr(cr.Spec.ExternalHost, nodePorts),
-	})
+	members, zones, err := s.memberPlacement(ctx, cr)
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
 
+	if status != cr.Status.Status {
+		eventType := corev1.EventTypeNormal
+		if status == dbv1.StatusFailed {
+			eventType = corev1.EventTypeWarning
+		}
+		s.kcli.Event(eventType, ReasonStatusChanged, "status changed from %q to %q", cr.Status.Status, status)
+	}
+
+	// keep fields owned by other steps, e.g. upgrade
+	newStatus := cr.Status
+	newStatus.Status = status
+	newStatus.ConnectAddr = strings.Join(addrs, ",")
+	newStatus.Members = members
+	// reconciled to the end, the spec is fine
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+		Type:               dbv1.ConditionDegraded,
+		Status:             metav1.ConditionFalse,
+		Reason:             dbv1.ReasonReconciled,
+		ObservedGeneration: cr.Generation,
+	})
+	s.checkZones(cr, &newStatus, zones)
+
+	s.UpdateStatus(cr, newStatus)
+
 	if status != dbv1.StatusReady {
 		return rerr.Err_wait_requeue
 	}
@@ -72,14 +117,113 @@ func (s *statusManager) HandleStatus(cr *dbv1.Etcd, nodePorts []int32) error {
 	return nil
 }
 
-func externalConnectAddr(host string, nodePorts []int32) string {
-	r := ""
+// memberPlacement node and zone of every scheduled member, and the number of zones the members span
+func (s *statusManager) memberPlacement(ctx context.Context, cr *dbv1.Etcd) ([]dbv1.MemberStatus, int, error) {
+	pods := &corev1.PodList{}
+	err := s.kcli.ListByLabel(ctx, cr.Namespace, MemberLabel(cr.ObjectMeta, SelectAll), pods)
+	if err != nil {
+		return nil, 0, errx.WithStackOnce(err)
+	}
 
-	f := "%s:%d,"
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].Name < pods.Items[j].Name
+	})
 
-	for _, port := range nodePorts {
-		r += fmt.Sprintf(f, host, port)
+	nodeZone := map[string]string{}
+	zones := map[string]bool{}
+	var r []dbv1.MemberStatus
+	for _, pod := range pods.Items {
+		name := pod.Spec.NodeName
+		if _, ok := nodeZone[name]; !ok && name != "" {
+			zone, err := s.nodeZone(ctx, name)
+			if err != nil {
+				return nil, 0, errx.WithStackOnce(err)
+			}
+			nodeZone[name] = zone
+			if zone != "" {
+				zones[zone] = true
+			}
+		}
+
+		r = append(r, dbv1.MemberStatus{
+			Name: pod.Name,
+			Node: name,
+			Zone: nodeZone[name],
+		})
 	}
 
-	return r[:len(r)-1] // rm trailing comma
+	return r, len(zones), nil
+}
+
+// nodeZone read by name from the API server, Nodes are not cached so the operator does not watch every Node.
+// Only the metadata is fetched, a removed Node has no zone.
+func (s *statusManager) nodeZone(ctx context.Context, name string) (string, error) {
+	node := &metav1.PartialObjectMetadata{}
+	node.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Node"))
+	err := s.kcli.FindLatest(ctx, name, "", node)
+	if k8serr.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errx.WithStackOnce(err)
+	}
+
+	return node.Labels[dbv1.TopologyKeyZone], nil
+}
+
+// checkZones sets ZoneSpread, with a warning once losing a single zone would cost the cluster its quorum
+func (s *statusManager) checkZones(cr *dbv1.Etcd, status *dbv1.EtcdStatus, zones int) {
+	need := cr.ZonesNeeded()
+	if need == 0 {
+		meta.RemoveStatusCondition(&status.Conditions, dbv1.ConditionZoneSpread)
+		return
+	}
+
+	cond := metav1.Condition{
+		Type:               dbv1.ConditionZoneSpread,
+		Status:             metav1.ConditionTrue,
+		Reason:             dbv1.ReasonEnoughZones,
+		Message:            fmt.Sprintf("%d members span %d zones, %d needed", cr.Spec.Members, zones, need),
+		ObservedGeneration: cr.Generation,
+	}
+	if zones < need {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = dbv1.ReasonInsufficientZones
+		cond.Message = fmt.Sprintf("%d members need %d zones to survive a zone outage, only %d found", cr.Spec.Members, need, zones)
+
+		if !meta.IsStatusConditionFalse(status.Conditions, dbv1.ConditionZoneSpread) {
+			s.kcli.Event(corev1.EventTypeWarning, dbv1.ReasonInsufficientZones, "%s", cond.Message)
+		}
+	}
+
+	meta.SetStatusCondition(&status.Conditions, cond)
+}
+
+// SetDegraded the spec can not be reconciled, cleared by HandleStatus once it is
+func (s *controller) SetDegraded(err error) {
+	meta.SetStatusCondition(&s.cr.Status.Conditions, metav1.Condition{
+		Type:               dbv1.ConditionDegraded,
+		Status:             metav1.ConditionTrue,
+		Reason:             dbv1.ReasonInvalidSpec,
+		Message:            err.Error(),
+		ObservedGeneration: s.cr.Generation,
+	})
+
+	s.writeStatus()
+}
+
+// writeStatus marks the status changed by a step, it is written with the rest by FlushStatus
+// however the reconcile ends
+func (s *controller) writeStatus() {
+	s.StatusManager.UpdateStatus(s.cr, s.cr.Status)
+}
+
+// persistStatus writes the status now, for phases that must be recorded before the step acts on them
+func (s *controller) persistStatus() error {
+	s.writeStatus()
+	return s.FlushStatus()
+}
+
+func (s *controller) FlushStatus() error {
+	return s.StatusManager.Flush(s.ctx, s.cr)
 }
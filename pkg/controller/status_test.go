@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/k8s"
+	"github.com/win5do/etcd-operator/pkg/metrics"
+)
+
+func TestFlushStatus(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, dbv1.AddToScheme(scheme))
+
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1"},
+		Status:     dbv1.EtcdStatus{Status: dbv1.StatusPartialReady},
+	}).Build()
+	key := types.NamespacedName{Name: "foo", Namespace: "default"}
+
+	cr := &dbv1.Etcd{}
+	require.NoError(t, cli.Get(ctx, key, cr))
+	sm := &statusManager{kcli: k8s.NewKcli(cli, nil, scheme, nil, cr, nil)}
+
+	// nothing pending, nothing is sent
+	require.NoError(t, sm.Flush(ctx, cr))
+
+	// several updates in one reconcile, one write
+	st := cr.Status
+	st.Status = dbv1.StatusReady
+	sm.UpdateStatus(cr, st)
+	sm.UpdateStatus(cr, st)
+	require.NoError(t, sm.Flush(ctx, cr))
+
+	got := &dbv1.Etcd{}
+	require.NoError(t, cli.Get(ctx, key, got))
+	require.Equal(t, dbv1.StatusReady, got.Status.Status)
+
+	// unchanged since written, skipped
+	skipped := testutil.ToFloat64(metrics.StatusWritesSkipped)
+	sm.UpdateStatus(cr, cr.Status)
+	require.NoError(t, sm.Flush(ctx, cr))
+	require.Equal(t, skipped+1, testutil.ToFloat64(metrics.StatusWritesSkipped))
+	require.NoError(t, cli.Get(ctx, key, got))
+	require.Equal(t, cr.ResourceVersion, got.ResourceVersion)
+}
+
+func TestZoneSpread(t *testing.T) {
+	node := func(name, zone string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{dbv1.TopologyKeyZone: zone}}}
+	}
+	pod := func(id int, node string) *corev1.Pod {
+		cr := testEtcd(3)
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("foo-%d", id), Namespace: "default", Labels: MemberLabel(cr.ObjectMeta, id)},
+			Spec:       corev1.PodSpec{NodeName: node},
+		}
+	}
+
+	cr := testEtcd(3)
+	cr.Spec.Placement = &dbv1.Placement{TopologyKeys: []string{dbv1.TopologyKeyZone}}
+	// n3 hosts no member, gone was removed, foo-3 is not scheduled yet
+	ct, _ := newFakeController(t, cr, node("n1", "a"), node("n2", "a"), node("n3", "c"),
+		pod(0, "n1"), pod(1, "n2"), pod(2, "gone"), pod(3, ""))
+	sm := ct.StatusManager
+
+	members, zones, err := sm.memberPlacement(ct.ctx, cr)
+	require.NoError(t, err)
+	require.Equal(t, 1, zones)
+	require.Equal(t, []dbv1.MemberStatus{
+		{Name: "foo-0", Node: "n1", Zone: "a"},
+		{Name: "foo-1", Node: "n2", Zone: "a"},
+		{Name: "foo-2", Node: "gone"},
+		{Name: "foo-3"},
+	}, members)
+
+	st := cr.Status
+	sm.checkZones(cr, &st, zones)
+	cond := meta.FindStatusCondition(st.Conditions, dbv1.ConditionZoneSpread)
+	require.NotNil(t, cond)
+	require.Equal(t, metav1.ConditionFalse, cond.Status)
+	require.Equal(t, dbv1.ReasonInsufficientZones, cond.Reason)
+
+	sm.checkZones(cr, &st, 3)
+	require.True(t, meta.IsStatusConditionTrue(st.Conditions, dbv1.ConditionZoneSpread))
+
+	// not spread by zone
+	cr.Spec.Placement = nil
+	sm.checkZones(cr, &st, 3)
+	require.Nil(t, meta.FindStatusCondition(st.Conditions, dbv1.ConditionZoneSpread))
+}
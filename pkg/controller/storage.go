@@ -0,0 +1,185 @@
+package controller
+
+import (
+	errors2 "github.com/pkg/errors"
+	"github.com/win5do/go-lib/errx"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrlcli "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+// SyncStorage expands member PVCs when spec.storage or spec.walStorage grows,
+// and adds the labels and annotations of the claim templates to the existing PVCs.
+// VolumeClaimTemplates are immutable, so once every PVC has been resized the
+// StatefulSet is deleted with orphan propagation and recreated by the sts step.
+func (s *controller) SyncStorage() error {
+	cr := s.cr
+
+	sts := &appsv1.StatefulSet{}
+	ok, err := s.Kcli.IsExists(s.ctx, &metav1.ObjectMeta{Name: cr.Name, Namespace: cr.Namespace}, sts)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	if !ok {
+		return nil
+	}
+
+	if sts.DeletionTimestamp != nil {
+		s.reqLog.Debug("wait statefulset orphan deletion")
+		return errors2.WithStack(rerr.Err_wait_requeue)
+	}
+
+	grow := false
+	resized := true
+	newSts := s.Builder.StatefulSet(MemberLabel(cr.ObjectMeta, SelectAll))
+	for _, claim := range newSts.Spec.VolumeClaimTemplates {
+		for i := 0; i < cr.Spec.Members; i++ {
+			err := s.syncPVCMetadata(AddSuffix(claim.Name, podName(cr.Name, i)), claim.ObjectMeta)
+			if err != nil {
+				return errx.WithStackOnce(err)
+			}
+		}
+
+		current, ok := claimTemplateStorage(sts, claim.Name)
+		if !ok {
+			continue
+		}
+
+		desired := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+		if desired.Cmp(current) <= 0 {
+			// shrinking is rejected by the webhook
+			continue
+		}
+		grow = true
+
+		for i := 0; i < cr.Spec.Members; i++ {
+			done, err := s.expandPVC(AddSuffix(claim.Name, podName(cr.Name, i)), desired)
+			if err != nil {
+				return errx.WithStackOnce(err)
+			}
+			resized = resized && done
+		}
+	}
+
+	if !grow {
+		return nil
+	}
+
+	if !resized {
+		s.reqLog.Debug("wait PVCs resized")
+		return errors2.WithStack(rerr.Err_wait_requeue)
+	}
+
+	s.reqLog.Info("PVCs resized, recreate statefulset")
+	err = s.Kcli.DeleteObject(s.ctx, sts, ctrlcli.PropagationPolicy(metav1.DeletePropagationOrphan))
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return errors2.WithStack(rerr.Err_wait_requeue)
+}
+
+// expandPVC patches the storage request and reports whether the filesystem has been resized
+func (s *controller) expandPVC(name string, desired resource.Quantity) (bool, error) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := s.Kcli.Find(s.ctx, name, s.cr.Namespace, pvc)
+	if err != nil {
+		if k8serr.IsNotFound(err) {
+			// member not created yet, it will get the new template
+			return true, nil
+		}
+		return false, errx.WithStackOnce(err)
+	}
+
+	request := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	if request.Cmp(desired) < 0 {
+		err := s.checkExpandable(pvc)
+		if err != nil {
+			return false, errx.WithStackOnce(err)
+		}
+
+		s.reqLog.Infof("expand PVC %s from %s to %s", name, request.String(), desired.String())
+		err = s.Kcli.PatchObject(s.ctx, pvc, &corev1.PersistentVolumeClaim{
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: desired,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return false, errx.WithStackOnce(err)
+		}
+
+		return false, nil
+	}
+
+	capacity := pvc.Status.Capacity[corev1.ResourceStorage]
+	if capacity.Cmp(desired) < 0 {
+		return false, nil
+	}
+
+	for _, c := range pvc.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		if c.Type == corev1.PersistentVolumeClaimResizing || c.Type == corev1.PersistentVolumeClaimFileSystemResizePending {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// syncPVCMetadata labels and annotations removed from spec.metadata are left on the PVC
+func (s *controller) syncPVCMetadata(name string, template metav1.ObjectMeta) error {
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := s.Kcli.Find(s.ctx, name, s.cr.Namespace, pvc)
+	if err != nil {
+		if k8serr.IsNotFound(err) {
+			return nil
+		}
+		return errx.WithStackOnce(err)
+	}
+
+	return s.syncMetadata(pvc, template)
+}
+
+func (s *controller) checkExpandable(pvc *corev1.PersistentVolumeClaim) error {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return errors2.Wrapf(rerr.Err_invalid_spec, "PVC %s has no storage class, can not expand", pvc.Name)
+	}
+
+	sc := &storagev1.StorageClass{}
+	err := s.Kcli.Find(s.ctx, *pvc.Spec.StorageClassName, "", sc)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	if sc.AllowVolumeExpansion == nil || !*sc.AllowVolumeExpansion {
+		return errors2.Wrapf(rerr.Err_invalid_spec, "storage class %s does not allow volume expansion", sc.Name)
+	}
+
+	return nil
+}
+
+func claimTemplateStorage(sts *appsv1.StatefulSet, name string) (resource.Quantity, bool) {
+	for _, v := range sts.Spec.VolumeClaimTemplates {
+		if v.Name != name {
+			continue
+		}
+
+		q, ok := v.Spec.Resources.Requests[corev1.ResourceStorage]
+		return q, ok
+	}
+
+	return resource.Quantity{}, false
+}
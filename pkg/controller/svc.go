@@ -1,23 +1,30 @@
 package controller
 
 import (
+	"fmt"
 	"strconv"
 
 	errors2 "github.com/pkg/errors"
 	"github.com/win5do/go-lib/errx"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
 )
 
 func (s *controller) ListSvcNodePort(portName, namespace string, labels map[string]string) ([]int32, error) {
 	found := &corev1.ServiceList{}
-	if err := s.Kcli.ListByLabel(namespace, labels, found); err != nil {
+	if err := s.Kcli.ListByLabel(s.ctx, namespace, labels, found); err != nil {
 		return nil, errx.WithStackOnce(err)
 	}
 
 	var nodePorts []int32
 
 	for _, svc := range found.Items {
+		if svc.Spec.Type != corev1.ServiceTypeNodePort {
+			continue
+		}
+
 		for _, v := range svc.Spec.Ports {
 			if v.Name != portName {
 				continue
@@ -34,40 +41,181 @@ func (s *controller) ListSvcNodePort(portName, namespace string, labels map[stri
 	return nodePorts, nil
 }
 
+// ListSvcAddr client addresses matching spec.service.type, reported in status.connectAddr
+func (s *controller) ListSvcAddr() ([]string, error) {
+	cr := s.cr
+
+	switch exposure(cr) {
+	case dbv1.ServiceExposureNone:
+		return memberAddrs(cr), nil
+	case dbv1.ServiceExposureClusterIP:
+		return []string{fmt.Sprintf("%s.%s.svc:%d", AddSuffix(cr.Name, Client), cr.Namespace, portClient)}, nil
+	case dbv1.ServiceExposureNodePort:
+		nodePorts, err := s.ListSvcNodePort(PortClientName, cr.Namespace, ExportSvcLabel(cr.ObjectMeta, SelectAll))
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+
+		var r []string
+		for _, port := range nodePorts {
+			r = append(r, fmt.Sprintf("%s:%d", cr.Spec.ExternalHost, port))
+		}
+		return r, nil
+	}
+
+	hosts, err := s.loadBalancerHosts()
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	var r []string
+	for _, host := range hosts {
+		r = append(r, fmt.Sprintf("%s:%d", host, portClient))
+	}
+
+	return r, nil
+}
+
+// loadBalancerHosts ingress IPs and hostnames of the client load balancers,
+// pending load balancers are reported once the cloud provider assigns them
+func (s *controller) loadBalancerHosts() ([]string, error) {
+	cr := s.cr
+
+	found := &corev1.ServiceList{}
+	err := s.Kcli.ListByLabel(s.ctx, cr.Namespace, ExportSvcLabel(cr.ObjectMeta, SelectAll), found)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	var r []string
+	for _, svc := range found.Items {
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+
+		for _, v := range svc.Status.LoadBalancer.Ingress {
+			host := v.IP
+			if host == "" {
+				host = v.Hostname
+			}
+			r = append(r, host)
+		}
+	}
+
+	return r, nil
+}
+
 func (s *controller) SyncSvc() error {
 	cr := s.cr
 
-	for i := 0; i < cr.Spec.Members; i++ {
-		err := s.Kcli.EnsureService(s.Builder.ExportService(
-			AddSuffix(cr.Name, Export, strconv.Itoa(i)),
-			ExportSvcLabel(cr.ObjectMeta, i),
-			MemberLabel(cr.ObjectMeta, i),
-		))
+	desired := map[string]bool{}
+	for _, svc := range s.exportServices() {
+		desired[svc.Name] = true
+
+		err := s.SyncService(svc)
 		if err != nil {
 			return errx.WithStackOnce(err)
 		}
 	}
 
 	svcList := &corev1.ServiceList{}
-	err := s.Kcli.ListByLabel(cr.Namespace, ExportSvcLabel(cr.ObjectMeta, SelectAll), svcList)
+	err := s.Kcli.ListByLabel(s.ctx, cr.Namespace, ExportSvcLabel(cr.ObjectMeta, SelectAll), svcList)
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
 
-	svcLen := len(svcList.Items)
-	for svcLen > cr.Spec.Members {
+	for i := range svcList.Items {
+		svc := &svcList.Items[i]
+		if desired[svc.Name] {
+			continue
+		}
+
 		// service not support deletecollection. Ref: https://github.com/kubernetes/client-go/issues/505#issuecomment-440678666
-		err := s.Kcli.DeleteObject(&corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      AddSuffix(cr.Name, Export, strconv.Itoa(svcLen-1)),
-				Namespace: cr.Namespace,
-			},
-		})
+		err := s.Kcli.DeleteObject(s.ctx, svc)
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+		s.Kcli.Event(corev1.EventTypeNormal, ReasonServicePruned, "deleted Service %s", svc.Name)
+	}
+
+	err = s.syncNetworkPolicy()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+// exportServices client Services for spec.service.type
+func (s *controller) exportServices() []*corev1.Service {
+	cr := s.cr
+
+	var r []*corev1.Service
+	switch exposure(cr) {
+	case dbv1.ServiceExposureNodePort, dbv1.ServiceExposureLoadBalancer:
+		svcType := corev1.ServiceTypeNodePort
+		if exposure(cr) == dbv1.ServiceExposureLoadBalancer {
+			svcType = corev1.ServiceTypeLoadBalancer
+		}
+
+		for i := 0; i < cr.Spec.Members; i++ {
+			r = append(r, s.Builder.ExportService(
+				AddSuffix(cr.Name, Export, strconv.Itoa(i)),
+				svcType,
+				ExportSvcLabel(cr.ObjectMeta, i),
+				MemberLabel(cr.ObjectMeta, i),
+			))
+		}
+	case dbv1.ServiceExposureClusterIP, dbv1.ServiceExposureSharedLoadBalancer:
+		svcType := corev1.ServiceTypeClusterIP
+		if exposure(cr) == dbv1.ServiceExposureSharedLoadBalancer {
+			svcType = corev1.ServiceTypeLoadBalancer
+		}
+
+		r = append(r, s.Builder.ExportService(
+			AddSuffix(cr.Name, Client),
+			svcType,
+			ExportSvcLabel(cr.ObjectMeta, SelectAll),
+			MemberLabel(cr.ObjectMeta, SelectAll),
+		))
+	}
+
+	return r
+}
+
+// SyncService applies svc, manual edits of the fields it sets are reverted.
+// Annotations removed from spec.service are removed from the Service by the apply,
+// the operator's field manager owns them, those added by others are kept
+func (s *controller) SyncService(svc *corev1.Service) error {
+	found := &corev1.Service{}
+	exists, err := s.Kcli.IsExists(s.ctx, svc, found)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	if exists && found.Spec.Type != svc.Spec.Type {
+		// nodePorts and clusterIP do not carry over between types cleanly, recreate
+		s.reqLog.Infof("service %s type changed from %s to %s, recreate", svc.Name, found.Spec.Type, svc.Spec.Type)
+		err := s.Kcli.DeleteObject(s.ctx, found)
 		if err != nil {
 			return errx.WithStackOnce(err)
 		}
-		svcLen--
+
+		return errors2.WithStack(rerr.Err_wait_requeue)
+	}
+
+	err = s.Kcli.Apply(s.ctx, svc)
+	if err != nil {
+		return errx.WithStackOnce(err)
 	}
 
 	return nil
 }
+
+func exposure(cr *dbv1.Etcd) dbv1.ServiceExposure {
+	if cr.Spec.Service == nil || cr.Spec.Service.Type == "" {
+		return dbv1.ServiceExposureNodePort
+	}
+
+	return cr.Spec.Service.Type
+}
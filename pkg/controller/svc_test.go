@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestExportServices(t *testing.T) {
+	cases := []struct {
+		exposure dbv1.ServiceExposure
+		names    []string
+		svcType  corev1.ServiceType
+	}{
+		{"", []string{"foo-export-0", "foo-export-1", "foo-export-2"}, corev1.ServiceTypeNodePort},
+		{dbv1.ServiceExposureNodePort, []string{"foo-export-0", "foo-export-1", "foo-export-2"}, corev1.ServiceTypeNodePort},
+		{dbv1.ServiceExposureLoadBalancer, []string{"foo-export-0", "foo-export-1", "foo-export-2"}, corev1.ServiceTypeLoadBalancer},
+		{dbv1.ServiceExposureClusterIP, []string{"foo-client"}, corev1.ServiceTypeClusterIP},
+		{dbv1.ServiceExposureSharedLoadBalancer, []string{"foo-client"}, corev1.ServiceTypeLoadBalancer},
+		{dbv1.ServiceExposureNone, nil, ""},
+	}
+
+	for _, c := range cases {
+		cr := &dbv1.Etcd{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+			},
+			Spec: dbv1.EtcdSpec{
+				Members: 3,
+				Service: &dbv1.ServiceSpec{
+					Type:        c.exposure,
+					Annotations: map[string]string{"lb": "internal"},
+				},
+			},
+		}
+		ct := &controller{
+			cr:      cr,
+			Builder: NewResourceBuilder(cr),
+		}
+
+		var names []string
+		for _, svc := range ct.exportServices() {
+			names = append(names, svc.Name)
+			require.Equal(t, c.svcType, svc.Spec.Type, c.exposure)
+			require.Equal(t, "internal", svc.Annotations["lb"], c.exposure)
+		}
+		require.Equal(t, c.names, names, c.exposure)
+	}
+}
+
+func TestListSvcAddrInCluster(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 2,
+			Service: &dbv1.ServiceSpec{Type: dbv1.ServiceExposureNone},
+		},
+	}
+	ct := &controller{cr: cr}
+
+	addrs, err := ct.ListSvcAddr()
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-0.foo.default.svc:2379", "foo-1.foo.default.svc:2379"}, addrs)
+
+	cr.Spec.Service.Type = dbv1.ServiceExposureClusterIP
+	addrs, err = ct.ListSvcAddr()
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-client.default.svc:2379"}, addrs)
+}
@@ -0,0 +1,257 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"reflect"
+	"sort"
+
+	errors2 "github.com/pkg/errors"
+	"github.com/win5do/go-lib/errx"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/pki"
+)
+
+const (
+	CACertKey = "ca.crt"
+	caKeyKey  = "ca.key"
+
+	serverCertCN = "etcd-server"
+
+	// certHosts hash of the SANs a cert was issued for, a change reissues it
+	certHosts = "etcd-operator/cert-hosts"
+)
+
+// SyncTLS issues the cluster CA, the serving cert of the members, the client cert of the operator
+// and the client cert of applications.
+// The CA is kept for the life of the cluster, leaf certs are reissued before they expire
+// and etcd picks the new files up without a restart.
+func (s *controller) SyncTLS() error {
+	cr := s.cr
+
+	if !cr.TLSEnabled() {
+		return nil
+	}
+
+	ca, err := s.ensureCA()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	hosts, err := s.serverHosts()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	err = s.ensureCert(ca, tlsSecret(cr.ServerTLSSecretName()), serverCertCN, hosts,
+		// the grpc gateway dials the member with the serving cert
+		x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	err = s.ensureCert(ca, tlsSecret(cr.ClientTLSSecretName()), clientCertCN(cr), nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	// with auth enabled etcd takes the CN as the user
+	err = s.ensureCert(ca, tlsSecret(cr.AppTLSSecretName()), appUser, nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+func (s *controller) ensureCA() (*pki.KeyPair, error) {
+	cr := s.cr
+
+	meta := s.Builder.secretMetadata(cr.CASecretName(), baseLabel(cr.ObjectMeta), certSecrets)
+	found := &corev1.Secret{}
+	err := s.findSecret(meta.Name, found)
+	if err == nil {
+		err := s.syncMetadata(found, meta)
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+		return pki.ParseKeyPair(found.Data[CACertKey], found.Data[caKeyKey])
+	}
+	if !k8serr.IsNotFound(err) {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	s.reqLog.Info("create cluster CA")
+	ca, err := pki.NewCA(cr.Name + "-ca")
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	err = s.Kcli.SetRefAndCreateObject(s.ctx, &corev1.Secret{
+		ObjectMeta: meta,
+		Data: map[string][]byte{
+			CACertKey: ca.CertPEM,
+			caKeyKey:  ca.KeyPEM,
+		},
+	})
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	return ca, nil
+}
+
+// certSecret where a cert is written, Extra is kept alongside and updated without reissuing
+type certSecret struct {
+	Name    string
+	Type    corev1.SecretType
+	CAKey   string
+	CertKey string
+	KeyKey  string
+	Extra   map[string][]byte
+}
+
+func tlsSecret(name string) certSecret {
+	return certSecret{
+		Name:    name,
+		Type:    corev1.SecretTypeTLS,
+		CAKey:   CACertKey,
+		CertKey: corev1.TLSCertKey,
+		KeyKey:  corev1.TLSPrivateKeyKey,
+	}
+}
+
+func (s *controller) ensureCert(ca *pki.KeyPair, secret certSecret, cn string, hosts []string, usages ...x509.ExtKeyUsage) error {
+	cr := s.cr
+
+	meta := s.Builder.secretMetadata(secret.Name, baseLabel(cr.ObjectMeta), certSecrets)
+	meta.Annotations = MergeLabels(meta.Annotations, map[string]string{certHosts: hashStr(hosts)})
+
+	found := &corev1.Secret{}
+	err := s.findSecret(secret.Name, found)
+	if err != nil && !k8serr.IsNotFound(err) {
+		return errx.WithStackOnce(err)
+	}
+	exists := err == nil
+
+	var certPEM, keyPEM []byte
+	if exists && bytes.Equal(found.Data[secret.CAKey], ca.CertPEM) && found.Annotations[certHosts] == hashStr(hosts) {
+		err := ca.Verify(found.Data[secret.CertKey], cn)
+		if err == nil {
+			certPEM, keyPEM = found.Data[secret.CertKey], found.Data[secret.KeyKey]
+		} else {
+			s.reqLog.Infof("reissue cert %s: %v", secret.Name, err)
+		}
+	}
+
+	if certPEM == nil {
+		cert, err := ca.Issue(cn, nil, hosts, usages...)
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+		certPEM, keyPEM = cert.CertPEM, cert.KeyPEM
+	}
+
+	data := map[string][]byte{
+		secret.CAKey:   ca.CertPEM,
+		secret.CertKey: certPEM,
+		secret.KeyKey:  keyPEM,
+	}
+	for k, v := range secret.Extra {
+		data[k] = v
+	}
+
+	if exists {
+		if reflect.DeepEqual(found.Data, data) {
+			return s.syncMetadata(found, meta)
+		}
+
+		return s.Kcli.UpdateObject(s.ctx, found, func() error {
+			found.Data = data
+			found.Labels = MergeLabels(found.Labels, meta.Labels)
+			found.Annotations = MergeLabels(found.Annotations, meta.Annotations)
+			return nil
+		})
+	}
+
+	return s.Kcli.SetRefAndCreateObject(s.ctx, &corev1.Secret{
+		ObjectMeta: meta,
+		Type:       secret.Type,
+		Data:       data,
+	})
+}
+
+// tlsConfig client side config of the operator, built from the client cert Secret
+func (s *controller) tlsConfig() (*tls.Config, error) {
+	cr := s.cr
+
+	found := &corev1.Secret{}
+	err := s.Kcli.Find(s.ctx, cr.ClientTLSSecretName(), cr.Namespace, found)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	cert, err := tls.X509KeyPair(found.Data[corev1.TLSCertKey], found.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(found.Data[CACertKey]) {
+		return nil, errors2.Errorf("invalid %s in secret %s", CACertKey, found.Name)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
+
+// serverHosts wildcards cover every member, so the cert does not depend on spec.members
+func serverHosts(cr *dbv1.Etcd) []string {
+	r := []string{
+		fmt.Sprintf("*.%s", cr.Name),
+		fmt.Sprintf("*.%s.%s.svc", cr.Name, cr.Namespace),
+		fmt.Sprintf("*.%s.%s.svc.cluster.local", cr.Name, cr.Namespace),
+		fmt.Sprintf("%s.%s.svc", cr.Name, cr.Namespace),
+		fmt.Sprintf("%s.%s.svc", AddSuffix(cr.Name, Client), cr.Namespace),
+		"localhost",
+		"127.0.0.1",
+	}
+
+	if cr.Spec.ExternalHost != "" {
+		r = append(r, cr.Spec.ExternalHost)
+	}
+
+	return r
+}
+
+// serverHosts also covers the load balancer addresses, the cert is reissued once they are assigned
+func (s *controller) serverHosts() ([]string, error) {
+	cr := s.cr
+
+	r := serverHosts(cr)
+
+	switch exposure(cr) {
+	case dbv1.ServiceExposureLoadBalancer, dbv1.ServiceExposureSharedLoadBalancer:
+		hosts, err := s.loadBalancerHosts()
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+
+		// list order is not stable, keep the hash of the SANs stable
+		sort.Strings(hosts)
+		r = append(r, hosts...)
+	}
+
+	return r, nil
+}
+
+func clientCertCN(cr *dbv1.Etcd) string {
+	return AddSuffix(cr.Name, Client)
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/k8s"
+)
+
+func TestTLSCommand(t *testing.T) {
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 1,
+			TLS:     &dbv1.TLSSpec{Enabled: true},
+		},
+	}
+
+	cmd := NewResourceBuilder(cr).command()[2]
+	require.Contains(t, cmd, "SCHEME=https")
+	require.Contains(t, cmd, "--client-cert-auth")
+	require.True(t, strings.HasPrefix(memberEndpoints(cr)[0], "https://"))
+}
+
+func TestServerHostsLoadBalancer(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+
+	cr := &dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+		},
+		Spec: dbv1.EtcdSpec{
+			Members: 1,
+			TLS:     &dbv1.TLSSpec{Enabled: true},
+			Service: &dbv1.ServiceSpec{Type: dbv1.ServiceExposureSharedLoadBalancer},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo-client",
+			Namespace: "default",
+			Labels:    ExportSvcLabel(cr.ObjectMeta, SelectAll),
+		},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{{IP: "203.0.113.10"}, {Hostname: "etcd.example.com"}},
+		}},
+	}).Build()
+	ct := &controller{
+		ctx:  ctx,
+		cr:   cr,
+		Kcli: k8s.NewKcli(cli, nil, scheme, nil, cr, nil),
+	}
+
+	hosts, err := ct.serverHosts()
+	require.NoError(t, err)
+	require.Contains(t, hosts, "203.0.113.10")
+	require.Contains(t, hosts, "etcd.example.com")
+
+	cr.Spec.Service.Type = dbv1.ServiceExposureClusterIP
+	hosts, err = ct.serverHosts()
+	require.NoError(t, err)
+	require.Equal(t, serverHosts(cr), hosts)
+}
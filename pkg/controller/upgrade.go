@@ -0,0 +1,316 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	errors2 "github.com/pkg/errors"
+	"github.com/win5do/go-lib/errx"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+const defaultMemberTimeout = 10 * time.Minute
+
+// SyncUpgrade rolls a change of spec.image out one member at a time.
+// The StatefulSet partition is lowered from the highest ordinal down, and only
+// after the previous member is healthy and its HashKV matches the others.
+func (s *controller) SyncUpgrade() error {
+	cr := s.cr
+
+	if cr.Status.Image == "" {
+		// new cluster, or created before upgrades were tracked
+		cr.Status.Image = cr.Spec.Image
+		return nil
+	}
+
+	up := cr.Status.Upgrade
+	if up == nil {
+		if cr.Status.Image == cr.Spec.Image {
+			return nil
+		}
+
+		return s.startUpgrade()
+	}
+
+	switch up.Phase {
+	case dbv1.UpgradePhaseSnapshot:
+		return s.upgradeSnapshot()
+	case dbv1.UpgradePhaseUpgrading:
+		return s.upgradeMember()
+	case dbv1.UpgradePhasePaused:
+		return s.upgradePaused()
+	}
+
+	return nil
+}
+
+func (s *controller) startUpgrade() error {
+	cr := s.cr
+
+	s.reqLog.Infof("start upgrade from %s to %s", cr.Status.Image, cr.Spec.Image)
+
+	// left by an attempt that ended before they were cleaned up
+	err := s.deleteSnapshotJobs(snapshotUpgrade)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	now := metav1.Now()
+	cr.Status.Upgrade = &dbv1.UpgradeStatus{
+		Phase:     dbv1.UpgradePhaseSnapshot,
+		FromImage: cr.Status.Image,
+		ToImage:   cr.Spec.Image,
+		Partition: int32(cr.Spec.Members),
+		StartTime: &now,
+	}
+
+	// recorded before the snapshot job is created
+	return s.persistStatus()
+}
+
+func (s *controller) upgradeSnapshot() error {
+	cr := s.cr
+	up := cr.Status.Upgrade
+
+	if cr.Spec.Image != up.ToImage {
+		// no member has been touched yet
+		s.reqLog.Infof("image changed before upgrade started, abort")
+		return s.endUpgrade()
+	}
+
+	dest, err := s.upgradeSnapshotDestination()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	done, err := s.EnsureSnapshot(upgradeSnapshotName(cr), snapshotUpgrade, dest)
+	if err != nil {
+		return s.pauseUpgrade(fmt.Sprintf("pre-upgrade snapshot: %v", err))
+	}
+	if !done {
+		s.reqLog.Debug("wait pre-upgrade snapshot")
+		return errors2.WithStack(rerr.Err_wait_requeue)
+	}
+
+	// recorded before the StatefulSet picks up ToImage
+	up.Phase = dbv1.UpgradePhaseUpgrading
+	return s.persistStatus()
+}
+
+func (s *controller) upgradeSnapshotDestination() (*dbv1.SnapshotDestination, error) {
+	if up := s.cr.Spec.Upgrade; up != nil && up.Snapshot != nil {
+		return up.Snapshot, nil
+	}
+
+	return s.defaultSnapshotDestination()
+}
+
+func (s *controller) upgradeMember() error {
+	cr := s.cr
+	up := cr.Status.Upgrade
+
+	if cr.Spec.Image != up.ToImage {
+		return s.pauseUpgrade(fmt.Sprintf("image changed to %s during upgrade", cr.Spec.Image))
+	}
+
+	if up.CurrentMember == nil {
+		if up.Partition == 0 {
+			return s.finishUpgrade()
+		}
+
+		// never take a member down while the cluster is degraded
+		err := s.checkCluster()
+		if err != nil {
+			s.reqLog.Infof("wait cluster healthy before upgrading next member: %v", err)
+			return errors2.WithStack(rerr.Err_wait_requeue)
+		}
+
+		next := up.Partition - 1
+		now := metav1.Now()
+		up.Partition = next
+		up.CurrentMember = &next
+		up.MemberStartTime = &now
+
+		s.reqLog.Infof("upgrade member %d to %s", next, up.ToImage)
+		// recorded before the StatefulSet partition is lowered
+		return s.persistStatus()
+	}
+
+	member := *up.CurrentMember
+	err := s.checkMemberUpgraded(int(member), up.ToImage)
+	if err == nil {
+		s.reqLog.Infof("member %d upgraded", member)
+		up.CurrentMember = nil
+		up.MemberStartTime = nil
+		s.writeStatus()
+		return nil
+	}
+
+	if up.MemberStartTime != nil && time.Since(up.MemberStartTime.Time) > s.memberTimeout() {
+		return s.pauseUpgrade(fmt.Sprintf("member %d failed to rejoin: %v", member, err))
+	}
+
+	s.reqLog.Debugf("wait member %d: %v", member, err)
+	return errors2.WithStack(rerr.Err_wait_requeue)
+}
+
+// pauseUpgrade reverts the StatefulSet to FromImage, the rollout stays paused until spec.image changes
+func (s *controller) pauseUpgrade(reason string) error {
+	up := s.cr.Status.Upgrade
+
+	s.reqLog.Warnf("pause upgrade to %s: %s", up.ToImage, reason)
+
+	up.Phase = dbv1.UpgradePhasePaused
+	up.Reason = reason
+
+	// recorded before the StatefulSet is reverted
+	return s.persistStatus()
+}
+
+func (s *controller) upgradePaused() error {
+	cr := s.cr
+	up := cr.Status.Upgrade
+
+	// A pod that never became ready is not replaced by the StatefulSet controller
+	// after the template is reverted, delete it so it comes back on FromImage.
+	reverted := true
+	for i := 0; i < cr.Spec.Members; i++ {
+		pod := &corev1.Pod{}
+		err := s.Kcli.Find(s.ctx, podName(cr.Name, i), cr.Namespace, pod)
+		if err != nil {
+			reverted = false
+			continue
+		}
+
+		if podImage(pod) == up.FromImage {
+			continue
+		}
+		reverted = false
+
+		if !podReady(pod) && pod.DeletionTimestamp == nil {
+			s.reqLog.Infof("delete member %d stuck on %s", i, podImage(pod))
+			err := s.Kcli.DeleteObject(s.ctx, pod)
+			if err != nil {
+				return errx.WithStackOnce(err)
+			}
+		}
+	}
+
+	if cr.Spec.Image == up.ToImage {
+		return nil
+	}
+
+	if !reverted {
+		s.reqLog.Debug("wait members reverted before leaving paused upgrade")
+		return errors2.WithStack(rerr.Err_wait_requeue)
+	}
+
+	// spec.image changed, a new upgrade starts from FromImage if needed
+	return s.endUpgrade()
+}
+
+func (s *controller) finishUpgrade() error {
+	cr := s.cr
+
+	s.reqLog.Infof("upgrade to %s finished", cr.Status.Upgrade.ToImage)
+
+	cr.Status.Image = cr.Status.Upgrade.ToImage
+	return s.endUpgrade()
+}
+
+// endUpgrade clears the upgrade status and the snapshot jobs it left
+func (s *controller) endUpgrade() error {
+	err := s.deleteSnapshotJobs(snapshotUpgrade)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	s.cr.Status.Upgrade = nil
+	s.writeStatus()
+	return nil
+}
+
+// upgradeSnapshotName unique per attempt, a retried upgrade must not find the job of the earlier one
+func upgradeSnapshotName(cr *dbv1.Etcd) string {
+	up := cr.Status.Upgrade
+
+	var start string
+	if up.StartTime != nil {
+		start = up.StartTime.UTC().Format(time.RFC3339)
+	}
+
+	return AddSuffix(cr.Name, snapshotUpgrade, hashStr(up.FromImage+up.ToImage+start))
+}
+
+func (s *controller) checkMemberUpgraded(id int, image string) error {
+	cr := s.cr
+
+	pod := &corev1.Pod{}
+	err := s.Kcli.Find(s.ctx, podName(cr.Name, id), cr.Namespace, pod)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	if podImage(pod) != image {
+		return errors2.Errorf("member %d still runs %s", id, podImage(pod))
+	}
+
+	if !podReady(pod) {
+		return errors2.Errorf("member %d not ready", id)
+	}
+
+	return s.checkCluster()
+}
+
+// checkCluster every member is healthy and holds the same data
+func (s *controller) checkCluster() error {
+	cli, err := s.etcdClient()
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	defer cli.Close()
+
+	err = cli.ClusterHealthy(s.ctx)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	err = cli.HashKVConsistent(s.ctx)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+func (s *controller) memberTimeout() time.Duration {
+	if up := s.cr.Spec.Upgrade; up != nil && up.MemberTimeoutSeconds > 0 {
+		return time.Duration(up.MemberTimeoutSeconds) * time.Second
+	}
+
+	return defaultMemberTimeout
+}
+
+func podImage(pod *corev1.Pod) string {
+	for _, c := range pod.Spec.Containers {
+		if c.Name == etcd {
+			return c.Image
+		}
+	}
+
+	return ""
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+	"github.com/win5do/etcd-operator/pkg/rerr"
+)
+
+const (
+	fromImage = "bitnami/etcd:3.5.9"
+	toImage   = "bitnami/etcd:3.5.12"
+)
+
+func upgradeStatus(phase dbv1.UpgradePhase, partition int32) *dbv1.UpgradeStatus {
+	start := metav1.NewTime(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))
+	return &dbv1.UpgradeStatus{
+		Phase:     phase,
+		FromImage: fromImage,
+		ToImage:   toImage,
+		Partition: partition,
+		StartTime: &start,
+	}
+}
+
+func memberPod(cr *dbv1.Etcd, id int, image string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: podName(cr.Name, id), Namespace: cr.Namespace},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: etcd, Image: image}}},
+		Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}},
+	}
+}
+
+// snapshotJob of the upgrade in progress, or of an earlier one
+func snapshotJob(cr *dbv1.Etcd, succeeded, failed int32) *batchv1.Job {
+	name := AddSuffix(cr.Name, snapshotUpgrade, "earlier")
+	if cr.Status.Upgrade != nil {
+		name = upgradeSnapshotName(cr)
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			UID:       "job-uid",
+			Namespace: cr.Namespace,
+			Labels:    MergeLabels(jobLabel(cr.ObjectMeta, snapshot), map[string]string{labelSnapshotFor: snapshotUpgrade}),
+		},
+		Spec:   batchv1.JobSpec{BackoffLimit: int32Ptr(snapshotBackoff)},
+		Status: batchv1.JobStatus{Succeeded: succeeded, Failed: failed},
+	}
+}
+
+func int32Ptr(v int32) *int32 {
+	return &v
+}
+
+func TestSyncUpgrade(t *testing.T) {
+	member2 := int32(2)
+	longAgo := metav1.NewTime(time.Now().Add(-time.Hour))
+	justNow := metav1.Now()
+
+	cases := []struct {
+		name    string
+		image   string
+		status  dbv1.EtcdStatus
+		objs    func(cr *dbv1.Etcd) []client.Object
+		wantErr error
+		check   func(t *testing.T, cr *dbv1.Etcd, cli client.Client)
+	}{
+		{
+			name:   "new cluster records its image",
+			image:  fromImage,
+			status: dbv1.EtcdStatus{},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, fromImage, cr.Status.Image)
+				require.Nil(t, cr.Status.Upgrade)
+			},
+		},
+		{
+			name:   "image change starts with a snapshot",
+			image:  toImage,
+			status: dbv1.EtcdStatus{Image: fromImage},
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				// left by an earlier attempt
+				return []client.Object{snapshotJob(cr, 1, 0)}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				up := cr.Status.Upgrade
+				require.Equal(t, dbv1.UpgradePhaseSnapshot, up.Phase)
+				require.Equal(t, int32(3), up.Partition)
+				require.NotNil(t, up.StartTime)
+				requireNoSnapshotJobs(t, cr, cli)
+			},
+		},
+		{
+			name:   "image changed back before any member is touched aborts",
+			image:  fromImage,
+			status: dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhaseSnapshot, 3)},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Nil(t, cr.Status.Upgrade)
+			},
+		},
+		{
+			name:    "snapshot job is created and waited for",
+			image:   toImage,
+			status:  dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhaseSnapshot, 3)},
+			wantErr: rerr.Err_wait_requeue,
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, dbv1.UpgradePhaseSnapshot, cr.Status.Upgrade.Phase)
+				job := &batchv1.Job{}
+				require.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: cr.Namespace, Name: upgradeSnapshotName(cr)}, job))
+			},
+		},
+		{
+			name:   "snapshot done starts upgrading",
+			image:  toImage,
+			status: dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhaseSnapshot, 3)},
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				return []client.Object{snapshotJob(cr, 1, 0)}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, dbv1.UpgradePhaseUpgrading, cr.Status.Upgrade.Phase)
+			},
+		},
+		{
+			name:   "snapshot failed pauses",
+			image:  toImage,
+			status: dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhaseSnapshot, 3)},
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				return []client.Object{snapshotJob(cr, 0, snapshotBackoff+1)}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, dbv1.UpgradePhasePaused, cr.Status.Upgrade.Phase)
+				require.Contains(t, cr.Status.Upgrade.Reason, "pre-upgrade snapshot")
+			},
+		},
+		{
+			name:   "image changed during upgrade pauses",
+			image:  "bitnami/etcd:3.5.13",
+			status: dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhaseUpgrading, 2)},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, dbv1.UpgradePhasePaused, cr.Status.Upgrade.Phase)
+				require.Contains(t, cr.Status.Upgrade.Reason, "image changed")
+			},
+		},
+		{
+			name:    "member not back yet waits",
+			image:   toImage,
+			status:  dbv1.EtcdStatus{Image: fromImage, Upgrade: withMember(upgradeStatus(dbv1.UpgradePhaseUpgrading, 2), &member2, &justNow)},
+			wantErr: rerr.Err_wait_requeue,
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				return []client.Object{memberPod(cr, 2, fromImage, true)}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, dbv1.UpgradePhaseUpgrading, cr.Status.Upgrade.Phase)
+			},
+		},
+		{
+			name:   "member not back in time pauses",
+			image:  toImage,
+			status: dbv1.EtcdStatus{Image: fromImage, Upgrade: withMember(upgradeStatus(dbv1.UpgradePhaseUpgrading, 2), &member2, &longAgo)},
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				return []client.Object{memberPod(cr, 2, toImage, false)}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, dbv1.UpgradePhasePaused, cr.Status.Upgrade.Phase)
+				require.Contains(t, cr.Status.Upgrade.Reason, "member 2 failed to rejoin")
+			},
+		},
+		{
+			name:   "every member upgraded finishes",
+			image:  toImage,
+			status: dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhaseUpgrading, 0)},
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				return []client.Object{snapshotJob(cr, 1, 0)}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, toImage, cr.Status.Image)
+				require.Nil(t, cr.Status.Upgrade)
+				requireNoSnapshotJobs(t, cr, cli)
+			},
+		},
+		{
+			name:   "paused deletes members stuck on ToImage",
+			image:  toImage,
+			status: dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhasePaused, 2)},
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				return []client.Object{
+					memberPod(cr, 0, fromImage, true),
+					memberPod(cr, 1, fromImage, true),
+					memberPod(cr, 2, toImage, false),
+				}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, dbv1.UpgradePhasePaused, cr.Status.Upgrade.Phase)
+				err := cli.Get(context.Background(), client.ObjectKey{Namespace: cr.Namespace, Name: podName(cr.Name, 2)}, &corev1.Pod{})
+				require.True(t, k8serr.IsNotFound(err))
+			},
+		},
+		{
+			name:    "paused waits for members reverted before a new image",
+			image:   "bitnami/etcd:3.5.13",
+			status:  dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhasePaused, 2)},
+			wantErr: rerr.Err_wait_requeue,
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				return []client.Object{
+					memberPod(cr, 0, fromImage, true),
+					memberPod(cr, 1, fromImage, true),
+					memberPod(cr, 2, toImage, true),
+				}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, dbv1.UpgradePhasePaused, cr.Status.Upgrade.Phase)
+			},
+		},
+		{
+			name:   "paused and reverted leaves the upgrade",
+			image:  "bitnami/etcd:3.5.13",
+			status: dbv1.EtcdStatus{Image: fromImage, Upgrade: upgradeStatus(dbv1.UpgradePhasePaused, 2)},
+			objs: func(cr *dbv1.Etcd) []client.Object {
+				return []client.Object{
+					memberPod(cr, 0, fromImage, true),
+					memberPod(cr, 1, fromImage, true),
+					memberPod(cr, 2, fromImage, true),
+					snapshotJob(cr, 1, 0),
+				}
+			},
+			check: func(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+				require.Equal(t, fromImage, cr.Status.Image)
+				require.Nil(t, cr.Status.Upgrade)
+				requireNoSnapshotJobs(t, cr, cli)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cr := testEtcd(3)
+			cr.Spec.Image = c.image
+			cr.Status = c.status
+
+			var objs []client.Object
+			if c.objs != nil {
+				objs = c.objs(cr)
+			}
+			ct, cli := newFakeController(t, cr, objs...)
+
+			err := ct.SyncUpgrade()
+			if c.wantErr != nil {
+				require.True(t, errors.Is(err, c.wantErr), "%+v", err)
+			} else {
+				require.NoError(t, err)
+			}
+			c.check(t, cr, cli)
+		})
+	}
+}
+
+func withMember(up *dbv1.UpgradeStatus, member *int32, start *metav1.Time) *dbv1.UpgradeStatus {
+	up.CurrentMember = member
+	up.MemberStartTime = start
+	return up
+}
+
+func requireNoSnapshotJobs(t *testing.T, cr *dbv1.Etcd, cli client.Client) {
+	list := &batchv1.JobList{}
+	require.NoError(t, cli.List(context.Background(), list, client.InNamespace(cr.Namespace)))
+	require.Empty(t, list.Items)
+}
+
+func TestUpgradeSnapshotName(t *testing.T) {
+	cr := testEtcd(3)
+	cr.Status.Upgrade = upgradeStatus(dbv1.UpgradePhaseSnapshot, 3)
+	first := upgradeSnapshotName(cr)
+
+	// same images, later attempt
+	retry := metav1.NewTime(cr.Status.Upgrade.StartTime.Add(time.Hour))
+	cr.Status.Upgrade.StartTime = &retry
+	require.NotEqual(t, first, upgradeSnapshotName(cr))
+}
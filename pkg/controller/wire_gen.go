@@ -6,8 +6,11 @@
 package controller
 
 import (
+	"context"
+
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/win5do/etcd-operator/api/v1"
@@ -17,13 +20,14 @@ import (
 
 // Injectors from wire.go:
 
-func Inject(cli client.Client, scheme *runtime.Scheme, cr *v1.Etcd, log *zap.SugaredLogger, cfg conf.Config) *controller {
-	kcli := k8s.NewKcli(cli, scheme, log, cr)
+func Inject(ctx context.Context, cli client.Client, reader client.Reader, scheme *runtime.Scheme, cr *v1.Etcd, log *zap.SugaredLogger, cfg conf.Config, recorder record.EventRecorder) *controller {
+	kcli := k8s.NewKcli(cli, reader, scheme, log, cr, recorder)
 	resourceBuilder := NewResourceBuilder(cr)
 	controllerStatusManager := &statusManager{
 		kcli: kcli,
 	}
 	controllerController := &controller{
+		ctx:           ctx,
 		reqLog:        log,
 		cr:            cr,
 		cfg:           cfg,
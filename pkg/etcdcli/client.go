@@ -0,0 +1,227 @@
+package etcdcli
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	errors2 "github.com/pkg/errors"
+	"github.com/win5do/go-lib/errx"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	DialTimeout = 5 * time.Second
+	CtxTimeout  = 10 * time.Second
+
+	rootRole = "root"
+
+	allKeys = "\x00"
+)
+
+// Client talks to the members of one etcd cluster
+type Client struct {
+	cli       *clientv3.Client
+	endpoints []string
+}
+
+type Config struct {
+	Endpoints []string
+	TLS       *tls.Config
+
+	// Username and Password are only set once auth is enabled on the cluster
+	Username string
+	Password string
+}
+
+// New ctx bounds the lifetime of the client, it is closed when ctx is done
+func New(ctx context.Context, cfg Config) (*Client, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Context:     ctx,
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: DialTimeout,
+		TLS:         cfg.TLS,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	return &Client{
+		cli:       cli,
+		endpoints: cfg.Endpoints,
+	}, nil
+}
+
+func (s *Client) Close() error {
+	return s.cli.Close()
+}
+
+// MemberHealthy checks the member behind endpoint has a leader and no errors
+func (s *Client) MemberHealthy(ctx context.Context, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+	resp, err := s.cli.Status(ctx, endpoint)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	if resp.Leader == 0 {
+		return errors2.Errorf("member %s has no leader", endpoint)
+	}
+
+	if len(resp.Errors) > 0 {
+		return errors2.Errorf("member %s has errors: %v", endpoint, resp.Errors)
+	}
+
+	return nil
+}
+
+func (s *Client) ClusterHealthy(ctx context.Context) error {
+	for _, ep := range s.endpoints {
+		err := s.MemberHealthy(ctx, ep)
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+	resp, err := s.cli.AlarmList(ctx)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	if len(resp.Alarms) > 0 {
+		return errors2.Errorf("cluster has alarms: %v", resp.Alarms)
+	}
+
+	return nil
+}
+
+// HashKVConsistent compares the kv hash of every member at the same revision
+func (s *Client) HashKVConsistent(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	status, err := s.cli.Status(ctx, s.endpoints[0])
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	rev := status.Header.Revision
+
+	var hash uint32
+	var compactRev int64
+	for i, ep := range s.endpoints {
+		resp, err := s.cli.HashKV(ctx, ep, rev)
+		if err != nil {
+			return errx.WithStackOnce(err)
+		}
+
+		if i == 0 {
+			hash, compactRev = resp.Hash, resp.CompactRevision
+			continue
+		}
+
+		if resp.Hash != hash || resp.CompactRevision != compactRev {
+			return errors2.Errorf("hashkv mismatch at revision %d: %s has %d, %s has %d",
+				rev, s.endpoints[0], hash, ep, resp.Hash)
+		}
+	}
+
+	return nil
+}
+
+// EnableAuth creates user with the root role and turns authentication on
+func (s *Client) EnableAuth(ctx context.Context, user, password string) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	_, err := s.cli.UserAdd(ctx, user, password)
+	if errors2.Is(err, rpctypes.ErrUserAlreadyExist) {
+		// left by an earlier attempt
+		_, err = s.cli.UserChangePassword(ctx, user, password)
+	}
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	_, err = s.cli.UserGrantRole(ctx, user, rootRole)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	_, err = s.cli.AuthEnable(ctx)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+func (s *Client) DisableAuth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	_, err := s.cli.AuthDisable(ctx)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+// EnsureAppUser creates user with role, which reads and writes every key but holds no root permissions,
+// so it can not manage users, auth or members. The same user serves a password and a cert of CN user.
+func (s *Client) EnsureAppUser(ctx context.Context, user, password, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	_, err := s.cli.RoleAdd(ctx, role)
+	if err != nil && !errors2.Is(err, rpctypes.ErrRoleAlreadyExist) {
+		return errx.WithStackOnce(err)
+	}
+
+	// a range end of \x00 covers every key from key on
+	_, err = s.cli.RoleGrantPermission(ctx, role, allKeys, allKeys, clientv3.PermissionType(clientv3.PermReadWrite))
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	_, err = s.cli.UserAdd(ctx, user, password)
+	if errors2.Is(err, rpctypes.ErrUserAlreadyExist) {
+		// left by an earlier attempt
+		_, err = s.cli.UserChangePassword(ctx, user, password)
+	}
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	_, err = s.cli.UserGrantRole(ctx, user, role)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+// GrantCertUser lets clients authenticating with a cert of CN name act as root while auth is enabled
+func (s *Client) GrantCertUser(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	_, err := s.cli.UserAddWithOptions(ctx, name, "", &clientv3.UserAddOptions{NoPassword: true})
+	if err != nil && !errors2.Is(err, rpctypes.ErrUserAlreadyExist) {
+		return errx.WithStackOnce(err)
+	}
+
+	_, err = s.cli.UserGrantRole(ctx, name, rootRole)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
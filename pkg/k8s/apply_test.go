@@ -0,0 +1,133 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrlcli "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+func TestApplyConfig(t *testing.T) {
+	obj := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", ResourceVersion: "3"},
+		Spec: appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "etcd"}}},
+			},
+		},
+	}
+
+	u, err := applyConfig(obj, appsv1.SchemeGroupVersion.WithKind("StatefulSet"))
+	require.NoError(t, err)
+	require.Equal(t, "apps/v1", u.GetAPIVersion())
+	require.Equal(t, "StatefulSet", u.GetKind())
+	require.Empty(t, u.GetResourceVersion())
+	require.NotContains(t, u.Object, "status")
+
+	_, ok, _ := unstructured.NestedFieldNoCopy(u.Object, "metadata", "creationTimestamp")
+	require.False(t, ok)
+	_, ok, _ = unstructured.NestedFieldNoCopy(u.Object, "spec", "template", "metadata")
+	require.False(t, ok)
+}
+
+// applyClient stands in for the API server on server-side apply, which the fake client does not support:
+// an applied object replaces the stored one, the first conflicts unforced applies fail as if
+// someone else owned the fields
+type applyClient struct {
+	ctrlcli.Client
+	conflicts int
+	applied   []*ctrlcli.PatchOptions
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj ctrlcli.Object, patch ctrlcli.Patch, opts ...ctrlcli.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+
+	po := &ctrlcli.PatchOptions{}
+	po.ApplyOptions(opts)
+	c.applied = append(c.applied, po)
+
+	force := po.Force != nil && *po.Force
+	if c.conflicts > 0 && !force {
+		c.conflicts--
+		return k8serr.NewConflict(schema.GroupResource{Resource: "configmaps"}, obj.GetName(),
+			errors.New(`Apply failed with 1 conflict: conflict with "kubectl" using v1: .data.k`))
+	}
+
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(obj.GetObjectKind().GroupVersionKind())
+	err := c.Client.Get(ctx, ctrlcli.ObjectKeyFromObject(obj), live)
+	if k8serr.IsNotFound(err) {
+		return c.Client.Create(ctx, obj)
+	}
+	if err != nil {
+		return err
+	}
+
+	obj.SetResourceVersion(live.GetResourceVersion())
+	return c.Client.Update(ctx, obj)
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	scheme := newScheme(t)
+
+	owner := &dbv1.Etcd{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1"}}
+	cli := &applyClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build()}
+	fr := record.NewFakeRecorder(10)
+	kcli := NewKcli(cli, nil, scheme, zap.NewNop().Sugar(), owner, fr)
+
+	newCm := func() *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Data:       map[string]string{"k": "v"},
+		}
+	}
+	key := types.NamespacedName{Name: "foo", Namespace: "default"}
+
+	// created, owned by the cr and applied by the operator's field manager
+	cm := newCm()
+	require.NoError(t, kcli.Apply(ctx, cm))
+	require.Len(t, cli.applied, 1)
+	require.Equal(t, "etcd-operator", cli.applied[0].FieldManager)
+	require.Nil(t, cli.applied[0].Force)
+	require.True(t, metav1.IsControlledBy(cm, owner))
+	require.NotEmpty(t, cm.ResourceVersion)
+	require.Equal(t, "Normal Created created ConfigMap foo", <-fr.Events)
+
+	// changed outside the operator
+	drifted := &corev1.ConfigMap{}
+	require.NoError(t, cli.Get(ctx, key, drifted))
+	drifted.Data["k"] = "changed"
+	require.NoError(t, cli.Update(ctx, drifted))
+
+	// the conflict is reported and the field taken back by force
+	cli.applied = nil
+	cli.conflicts = 1
+	require.NoError(t, kcli.Apply(ctx, newCm()))
+	require.Len(t, cli.applied, 2)
+	require.Equal(t, "etcd-operator", cli.applied[1].FieldManager)
+	require.NotNil(t, cli.applied[1].Force)
+	require.True(t, *cli.applied[1].Force)
+	require.Contains(t, <-fr.Events, "Warning DriftCorrected ConfigMap foo changed outside the operator, reverted")
+	require.Equal(t, "Normal Updated applied ConfigMap foo", <-fr.Events)
+
+	got := &corev1.ConfigMap{}
+	require.NoError(t, cli.Get(ctx, key, got))
+	require.Equal(t, "v", got.Data["k"])
+}
@@ -0,0 +1,81 @@
+package k8s
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	ReasonCreated        = "Created"
+	ReasonUpdated        = "Updated"
+	ReasonDriftCorrected = "DriftCorrected"
+
+	// seen is swept once it grows past this
+	maxSeenEvents = 1024
+)
+
+// DedupRecorder drops an event already recorded for the same version of the object within window,
+// a waiting reconcile is requeued every few seconds and would repeat it. Once the object is written,
+// e.g. its status changed, the same event is a new transition and recorded again
+type DedupRecorder struct {
+	record.EventRecorder
+
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time
+}
+
+var _ record.EventRecorder = &DedupRecorder{}
+
+func NewDedupRecorder(recorder record.EventRecorder, window time.Duration) *DedupRecorder {
+	return &DedupRecorder{
+		EventRecorder: recorder,
+		window:        window,
+		seen:          map[string]time.Time{},
+	}
+}
+
+func (s *DedupRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if !s.first(object, eventtype, reason, message) {
+		return
+	}
+
+	s.EventRecorder.Event(object, eventtype, reason, message)
+}
+
+func (s *DedupRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	s.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (s *DedupRecorder) first(object runtime.Object, eventtype, reason, message string) bool {
+	var uid, version string
+	if obj, err := meta.Accessor(object); err == nil {
+		uid = string(obj.GetUID())
+		version = obj.GetResourceVersion()
+	}
+	key := fmt.Sprintf("%s/%s/%s/%s/%s", uid, version, eventtype, reason, message)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.seen[key]; ok && now.Sub(t) < s.window {
+		return false
+	}
+
+	if len(s.seen) >= maxSeenEvents {
+		for k, t := range s.seen {
+			if now.Sub(t) >= s.window {
+				delete(s.seen, k)
+			}
+		}
+	}
+	s.seen[key] = now
+
+	return true
+}
@@ -9,47 +9,107 @@ import (
 	"go.uber.org/zap"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrlcli "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
-	"github.com/win5do/etcd-operator/pkg/rerr"
+	"github.com/win5do/etcd-operator/pkg/metrics"
 )
 
+// FieldManager owns the fields of server-side applied objects
+const FieldManager = "etcd-operator"
+
 type Kcli struct {
 	client ctrlcli.Client
-	scheme *runtime.Scheme
-	log    *zap.SugaredLogger
-	owner  metav1.Object
+	// reader reads around the cache, retries on conflict must see the latest resourceVersion
+	reader   ctrlcli.Reader
+	scheme   *runtime.Scheme
+	log      *zap.SugaredLogger
+	owner    metav1.Object
+	recorder record.EventRecorder
+
+	// statusBase the owner as last read or written, status patches are computed against it
+	statusBase ctrlcli.Object
 }
 
-func NewKcli(client ctrlcli.Client, scheme *runtime.Scheme, log *zap.SugaredLogger, obj metav1.Object) *Kcli {
-	return &Kcli{
-		client: client,
-		scheme: scheme,
-		log:    log,
-		owner:  obj,
+// NewKcli reader may be nil, client is used for uncached reads then
+func NewKcli(client ctrlcli.Client, reader ctrlcli.Reader, scheme *runtime.Scheme, log *zap.SugaredLogger, obj metav1.Object, recorder record.EventRecorder) *Kcli {
+	if reader == nil {
+		reader = client
+	}
+
+	r := &Kcli{
+		client:   client,
+		reader:   reader,
+		scheme:   scheme,
+		log:      log,
+		owner:    obj,
+		recorder: recorder,
+	}
+
+	if o, ok := obj.(ctrlcli.Object); ok {
+		r.statusBase = o.DeepCopyObject().(ctrlcli.Object)
 	}
+
+	return r
 }
 
-func (s *Kcli) Find(name, namespace string, found ctrlcli.Object) error {
-	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+// Event is recorded on the owner, so it shows in kubectl describe
+func (s *Kcli) Event(eventtype, reason, messageFmt string, args ...interface{}) {
+	owner, ok := s.owner.(runtime.Object)
+	if s.recorder == nil || !ok {
+		return
+	}
+
+	s.recorder.Eventf(owner, eventtype, reason, messageFmt, args...)
+}
+
+// changed records a Normal event for a change of a generated object, changes of the owner itself are left out
+func (s *Kcli) changed(obj ctrlcli.Object, reason, verb string) {
+	if obj.GetUID() != "" && obj.GetUID() == s.owner.GetUID() {
+		return
+	}
+
+	kind := obj.GetObjectKind().GroupVersionKind().Kind
+	if gvk, err := apiutil.GVKForObject(obj, s.scheme); err == nil {
+		kind = gvk.Kind
+	}
+
+	s.Event(corev1.EventTypeNormal, reason, "%s %s %s", verb, kind, obj.GetName())
+}
+
+func (s *Kcli) Find(ctx context.Context, name, namespace string, found ctrlcli.Object) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
 	defer cancel()
 	return s.client.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, found)
 }
 
-func (s *Kcli) ListByLabel(namespace string, labels map[string]string, found ctrlcli.ObjectList) error {
-	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+// FindLatest reads from the API server, the cache may lag behind a write just made
+func (s *Kcli) FindLatest(ctx context.Context, name, namespace string, found ctrlcli.Object) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+	return s.reader.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, found)
+}
+
+func (s *Kcli) ListByLabel(ctx context.Context, namespace string, labels map[string]string, found ctrlcli.ObjectList) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
 	defer cancel()
 	err := s.client.List(ctx, found, ctrlcli.InNamespace(namespace), ctrlcli.MatchingLabels(labels))
 	return errx.WithStackOnce(err)
 }
 
-func (s *Kcli) IsExists(obj metav1.Object, found ctrlcli.Object) (exists bool, err error) {
-	err = s.Find(obj.GetName(), obj.GetNamespace(), found)
+func (s *Kcli) IsExists(ctx context.Context, obj metav1.Object, found ctrlcli.Object) (exists bool, err error) {
+	err = s.Find(ctx, obj.GetName(), obj.GetNamespace(), found)
 	if err == nil {
 		return true, nil
 	}
@@ -60,14 +120,14 @@ func (s *Kcli) IsExists(obj metav1.Object, found ctrlcli.Object) (exists bool, e
 	return false, nil
 }
 
-func (s *Kcli) SetRefAndCreateObject(obj interface{}) error {
+func (s *Kcli) SetRefAndCreateObject(ctx context.Context, obj interface{}) error {
 	// Set cr as the owner and controller
 	err := controllerutil.SetControllerReference(s.owner, obj.(metav1.Object), s.scheme)
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
 
-	err = s.CreateObject(obj.(runtime.Object))
+	err = s.CreateObject(ctx, obj.(runtime.Object))
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
@@ -75,83 +135,297 @@ func (s *Kcli) SetRefAndCreateObject(obj interface{}) error {
 	return nil
 }
 
-func (s *Kcli) CreateObject(obj runtime.Object) error {
-	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+func (s *Kcli) CreateObject(ctx context.Context, obj runtime.Object) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
 	defer cancel()
 	err := s.client.Create(ctx, obj.(ctrlcli.Object))
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
+	s.changed(obj.(ctrlcli.Object), ReasonCreated, "created")
 
 	return nil
 }
 
-func (s *Kcli) UpdateObject(obj ctrlcli.Object) error {
-	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
-	defer cancel()
-	if err := s.client.Update(ctx, obj); err != nil {
+// UpdateObject applies mutate to obj and updates it, on conflict obj is read again and mutate reapplied
+func (s *Kcli) UpdateObject(ctx context.Context, obj ctrlcli.Object, mutate func() error) error {
+	attempt := 0
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if attempt > 0 {
+			err := s.FindLatest(ctx, obj.GetName(), obj.GetNamespace(), obj)
+			if err != nil {
+				return err
+			}
+		}
+		attempt++
+
+		if mutate != nil {
+			if err := mutate(); err != nil {
+				return err
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+		defer cancel()
+		return s.client.Update(ctx, obj)
+	})
+	if err != nil {
 		return errx.WithStackOnce(err)
 	}
+	s.changed(obj, ReasonUpdated, "updated")
 
 	return nil
 }
 
-func (s *Kcli) PatchObject(obj ctrlcli.Object, patch ctrlcli.Object) error {
+func (s *Kcli) PatchObject(ctx context.Context, obj ctrlcli.Object, patch ctrlcli.Object) error {
 	data, err := json.Marshal(patch)
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
 	defer cancel()
 	if err := s.client.Patch(ctx, obj, ctrlcli.RawPatch(types.StrategicMergePatchType, data)); err != nil {
 		return errx.WithStackOnce(err)
 	}
+	s.changed(obj, ReasonUpdated, "patched")
 
 	return nil
 }
 
-func (s *Kcli) WriteStatus(obj ctrlcli.Object) error {
-	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+// MergePatchObject json merge patch, a nil value in patch removes the field
+func (s *Kcli) MergePatchObject(ctx context.Context, obj ctrlcli.Object, patch interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
 	defer cancel()
-	err := s.client.Status().Update(ctx, obj)
+	if err := s.client.Patch(ctx, obj, ctrlcli.RawPatch(types.MergePatchType, data)); err != nil {
+		return errx.WithStackOnce(err)
+	}
+	s.changed(obj, ReasonUpdated, "patched")
+
+	return nil
+}
+
+// WriteStatus merge patches the status of the owner, only fields changed since it was last read or written are sent
+func (s *Kcli) WriteStatus(ctx context.Context, obj ctrlcli.Object) error {
+	same, err := sameStatus(s.statusBase, obj)
 	if err != nil {
-		s.log.Warnf("err: %+v", err)
+		return errx.WithStackOnce(err)
+	}
+	if same {
+		metrics.StatusWritesSkipped.Inc()
+		return nil
+	}
 
-		// may be it's k8s v1.10 and erlier (e.g. oc3.9) that doesn't support status updates
+	err = s.patchStatus(ctx, obj)
+	if k8serr.IsNotFound(err) {
+		s.log.Warnf("patch status: %v, update whole CR", err)
+
+		// may be it's k8s v1.10 and erlier (e.g. oc3.9) that doesn't support status subresource
 		// so try to update whole CR
-		ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
-		defer cancel()
-		err := s.client.Update(ctx, obj)
+		err = s.updateStatus(ctx, obj)
+	}
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	s.statusBase = obj.DeepCopyObject().(ctrlcli.Object)
+	return nil
+}
+
+func (s *Kcli) patchStatus(ctx context.Context, obj ctrlcli.Object) error {
+	base := s.statusBase
+	if base == nil || base.GetUID() != obj.GetUID() {
+		base = obj.DeepCopyObject().(ctrlcli.Object)
+		// diff against an empty status sends all of it
+		if err := clearStatus(base); err != nil {
+			return err
+		}
+	}
+	base = base.DeepCopyObject().(ctrlcli.Object)
+	// no precondition, metadata in the patch is ignored by the status subresource
+	base.SetResourceVersion(obj.GetResourceVersion())
+
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+	return s.client.Status().Patch(ctx, obj, ctrlcli.MergeFrom(base))
+}
+
+// updateStatus whole object update, on conflict the status is put on the latest version
+func (s *Kcli) updateStatus(ctx context.Context, obj ctrlcli.Object) error {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	status := u["status"]
+
+	return s.UpdateObject(ctx, obj, func() error {
+		latest, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
 		if err != nil {
-			s.log.Warnf("err: %+v", err)
-			return errors2.WithStack(rerr.Err_wait_requeue)
+			return err
 		}
+		latest["status"] = status
+
+		return runtime.DefaultUnstructuredConverter.FromUnstructured(latest, obj)
+	})
+}
+
+// sameStatus whether obj has the status of base, the owner as last read or written
+func sameStatus(base, obj ctrlcli.Object) (bool, error) {
+	if base == nil || base.GetUID() != obj.GetUID() {
+		return false, nil
 	}
 
-	return nil
+	a, err := runtime.DefaultUnstructuredConverter.ToUnstructured(base)
+	if err != nil {
+		return false, err
+	}
+	b, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return false, err
+	}
+
+	return equality.Semantic.DeepEqual(a["status"], b["status"]), nil
+}
+
+func clearStatus(obj ctrlcli.Object) error {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	delete(u, "status")
+
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u, obj)
 }
 
-func (s *Kcli) Ensure(obj metav1.Object, found ctrlcli.Object) error {
-	ok, err := s.IsExists(obj, found)
+// Apply server-side applies obj with the cr as controller, obj is filled with the live object.
+// Fields the operator applied and someone else changed since conflict, they are taken back by force and reported.
+func (s *Kcli) Apply(ctx context.Context, obj ctrlcli.Object) error {
+	err := controllerutil.SetControllerReference(s.owner, obj, s.scheme)
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
-	if ok {
+
+	gvk, err := apiutil.GVKForObject(obj, s.scheme)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	u, err := applyConfig(obj, gvk)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	found := obj.DeepCopyObject().(ctrlcli.Object)
+	exists, err := s.IsExists(ctx, obj, found)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	err = s.apply(ctx, u)
+	if k8serr.IsConflict(err) {
+		s.log.Warnf("%s %s drifted, force apply: %v", gvk.Kind, obj.GetName(), err)
+		s.Event(corev1.EventTypeWarning, ReasonDriftCorrected, "%s %s changed outside the operator, reverted: %v",
+			gvk.Kind, obj.GetName(), err)
+		err = s.apply(ctx, u, ctrlcli.ForceOwnership)
+	}
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	switch {
+	case !exists:
+		s.changed(u, ReasonCreated, "created")
+	case u.GetResourceVersion() != found.GetResourceVersion():
+		s.changed(u, ReasonUpdated, "applied")
+	}
+
+	if uo, ok := obj.(runtime.Unstructured); ok {
+		uo.SetUnstructuredContent(u.Object)
 		return nil
 	}
 
-	err = s.SetRefAndCreateObject(obj)
-	if k8serr.IsAlreadyExists(errors2.Unwrap(err)) {
+	return errx.WithStackOnce(runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj))
+}
+
+func (s *Kcli) apply(ctx context.Context, u *unstructured.Unstructured, opts ...ctrlcli.PatchOption) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	opts = append(opts, ctrlcli.FieldOwner(FieldManager))
+	return s.client.Patch(ctx, u, ctrlcli.Apply, opts...)
+}
+
+// applyConfig only the fields the builder sets, status and null values would be claimed by the operator otherwise
+func applyConfig(obj ctrlcli.Object, gvk schema.GroupVersionKind) (*unstructured.Unstructured, error) {
+	var content map[string]interface{}
+	if uo, ok := obj.(runtime.Unstructured); ok {
+		content = runtime.DeepCopyJSON(uo.UnstructuredContent())
+	} else {
+		var err error
+		content, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return nil, errx.WithStackOnce(err)
+		}
+	}
+
+	u := &unstructured.Unstructured{Object: pruneNull(content)}
+	delete(u.Object, "status")
+	u.SetGroupVersionKind(gvk)
+	u.SetResourceVersion("")
+	u.SetManagedFields(nil)
+
+	return u, nil
+}
+
+// pruneNull drops null values, e.g. creationTimestamp of templates, and the maps left empty by it
+func pruneNull(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		switch vv := v.(type) {
+		case nil:
+			delete(m, k)
+		case map[string]interface{}:
+			if len(vv) > 0 && len(pruneNull(vv)) == 0 {
+				delete(m, k)
+			}
+		case []interface{}:
+			for _, item := range vv {
+				if im, ok := item.(map[string]interface{}); ok {
+					pruneNull(im)
+				}
+			}
+		}
+	}
+
+	return m
+}
+
+// Ensure creates obj if missing, for kinds whose spec is immutable, e.g. jobs and PVCs.
+// found stays empty when obj was just created
+func (s *Kcli) Ensure(ctx context.Context, obj metav1.Object, found ctrlcli.Object) error {
+	ok, err := s.IsExists(ctx, obj, found)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+	if ok {
 		return nil
 	}
 
+	err = s.SetRefAndCreateObject(ctx, obj)
+	if err != nil && !k8serr.IsAlreadyExists(err) {
+		return errx.WithStackOnce(err)
+	}
+
 	return nil
 }
 
 // not set ownerRef，用于公用资源
-func (s *Kcli) EnsureOrphan(obj metav1.Object, found ctrlcli.Object) error {
-	ok, err := s.IsExists(obj, found)
+func (s *Kcli) EnsureOrphan(ctx context.Context, obj metav1.Object, found ctrlcli.Object) error {
+	ok, err := s.IsExists(ctx, obj, found)
 	if err != nil {
 		return errx.WithStackOnce(err)
 	}
@@ -159,18 +433,31 @@ func (s *Kcli) EnsureOrphan(obj metav1.Object, found ctrlcli.Object) error {
 		return nil
 	}
 
-	err = s.CreateObject(obj.(runtime.Object))
-	if k8serr.IsAlreadyExists(errors2.Unwrap(err)) {
-		return nil
+	err = s.CreateObject(ctx, obj.(runtime.Object))
+	if err != nil && !k8serr.IsAlreadyExists(err) {
+		return errx.WithStackOnce(err)
 	}
 
 	return nil
 }
 
-func (s *Kcli) DeleteObject(obj ctrlcli.Object) error {
-	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+// HasKind whether the API server serves gvk, e.g. a CRD that may not be installed
+func (s *Kcli) HasKind(gvk schema.GroupVersionKind) (bool, error) {
+	_, err := s.client.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err == nil {
+		return true, nil
+	}
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+
+	return false, errx.WithStackOnce(err)
+}
+
+func (s *Kcli) DeleteObject(ctx context.Context, obj ctrlcli.Object, opts ...ctrlcli.DeleteOption) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
 	defer cancel()
-	err := s.client.Delete(ctx, obj)
+	err := s.client.Delete(ctx, obj, opts...)
 	if err != nil && !k8serr.IsNotFound(err) {
 		return errx.WithStackOnce(err)
 	}
@@ -178,10 +465,11 @@ func (s *Kcli) DeleteObject(obj ctrlcli.Object) error {
 	return nil
 }
 
-func (s *Kcli) DeleteALLByLabel(obj ctrlcli.Object, namespace string, labels map[string]string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+func (s *Kcli) DeleteALLByLabel(ctx context.Context, obj ctrlcli.Object, namespace string, labels map[string]string, opts ...ctrlcli.DeleteAllOfOption) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
 	defer cancel()
-	err := s.client.DeleteAllOf(ctx, obj, ctrlcli.InNamespace(namespace), ctrlcli.MatchingLabels(labels))
+	opts = append(opts, ctrlcli.InNamespace(namespace), ctrlcli.MatchingLabels(labels))
+	err := s.client.DeleteAllOf(ctx, obj, opts...)
 	if err != nil && !k8serr.IsNotFound(err) {
 		return errx.WithStackOnce(err)
 	}
@@ -189,22 +477,20 @@ func (s *Kcli) DeleteALLByLabel(obj ctrlcli.Object, namespace string, labels map
 	return nil
 }
 
-func (s *Kcli) EnsurePVC(obj *corev1.PersistentVolumeClaim) error {
+func (s *Kcli) EnsurePVC(ctx context.Context, obj *corev1.PersistentVolumeClaim) error {
 	if obj == nil {
 		// 不需要pvc
 		return nil
 	}
 
 	found := &corev1.PersistentVolumeClaim{}
-	return s.Ensure(obj, found)
+	return s.Ensure(ctx, obj, found)
 }
 
-func (s *Kcli) EnsureStatefulSet(obj *appsv1.StatefulSet) error {
-	found := &appsv1.StatefulSet{}
-	return s.Ensure(obj, found)
+func (s *Kcli) EnsureStatefulSet(ctx context.Context, obj *appsv1.StatefulSet) error {
+	return s.Apply(ctx, obj)
 }
 
-func (s *Kcli) EnsureService(obj *corev1.Service) error {
-	found := &corev1.Service{}
-	return s.Ensure(obj, found)
+func (s *Kcli) EnsureService(ctx context.Context, obj *corev1.Service) error {
+	return s.Apply(ctx, obj)
 }
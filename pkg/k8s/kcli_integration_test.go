@@ -1,47 +1,52 @@
 package k8s
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrlcli "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/win5do/etcd-operator/pkg/test"
 )
 
-func TestMain(m *testing.M) {
-	if test.ShouldRun() {
-		m.Run()
-	}
-}
-
 func TestFind(t *testing.T) {
+	test.Integration(t)
+
 	kcli := Kcli{
 		client: test.Kcli(corev1.SchemeBuilder),
 	}
 
 	found := &corev1.ServiceAccount{}
-	err := kcli.Find("foo", "default", found)
+	err := kcli.Find(context.Background(), "foo", "default", found)
 	require.NoError(t, err)
 }
 
 func TestDeleteALL(t *testing.T) {
+	test.Integration(t)
+
 	kcli := Kcli{
 		client: test.Kcli(corev1.SchemeBuilder),
 	}
 
-	err := kcli.DeleteALLByLabel(&corev1.Service{}, "default", map[string]string{
+	err := kcli.DeleteALLByLabel(context.Background(), &corev1.Service{}, "default", map[string]string{
 		"svc": "export",
 	})
 	require.NoError(t, err)
 }
 
 func TestDeleteALLByLabel(t *testing.T) {
+	test.Integration(t)
+
 	kcli := Kcli{
 		client: test.Kcli(corev1.SchemeBuilder),
 	}
 
 	err := kcli.DeleteALLByLabel(
+		context.Background(),
 		&corev1.PersistentVolumeClaim{},
 		"default",
 		map[string]string{
@@ -50,3 +55,39 @@ func TestDeleteALLByLabel(t *testing.T) {
 	)
 	require.NoError(t, err)
 }
+
+// annotations the operator applied and no longer sets are removed, those added by others are kept
+func TestApplyPrunesAnnotations(t *testing.T) {
+	test.Integration(t)
+	ctx := context.Background()
+
+	cli := test.Kcli(corev1.SchemeBuilder)
+	owner := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "apply-test", Namespace: "default"}}
+	require.NoError(t, cli.Create(ctx, owner))
+	defer cli.Delete(ctx, owner)
+	kcli := NewKcli(cli, nil, cli.Scheme(), zap.NewNop().Sugar(), owner, nil)
+
+	newSvc := func(annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "apply-test", Namespace: "default", Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "client", Port: 2379}},
+			},
+		}
+	}
+
+	svc := newSvc(map[string]string{"lb": "internal", "dropped": "true"})
+	require.NoError(t, kcli.Apply(ctx, svc))
+	defer cli.Delete(ctx, svc)
+
+	svc.Annotations["other"] = "kept"
+	require.NoError(t, cli.Update(ctx, svc))
+
+	require.NoError(t, kcli.Apply(ctx, newSvc(map[string]string{"lb": "internal"})))
+
+	got := &corev1.Service{}
+	require.NoError(t, cli.Get(ctx, ctrlcli.ObjectKeyFromObject(svc), got))
+	require.Equal(t, "internal", got.Annotations["lb"])
+	require.Equal(t, "kept", got.Annotations["other"])
+	require.NotContains(t, got.Annotations, "dropped")
+}
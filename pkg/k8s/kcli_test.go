@@ -0,0 +1,114 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrlcli "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1 "github.com/win5do/etcd-operator/api/v1"
+)
+
+// staleClient a cache that has not seen any write since it was built
+type staleClient struct {
+	ctrlcli.Client
+	cached ctrlcli.Object
+}
+
+func (s *staleClient) Get(ctx context.Context, key ctrlcli.ObjectKey, obj ctrlcli.Object) error {
+	return s.Client.Scheme().Convert(s.cached.DeepCopyObject(), obj, nil)
+}
+
+func newScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, dbv1.AddToScheme(scheme))
+	return scheme
+}
+
+func TestUpdateObjectConflict(t *testing.T) {
+	ctx := context.Background()
+	scheme := newScheme(t)
+
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+	}).Build()
+	key := types.NamespacedName{Name: "foo", Namespace: "default"}
+
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, cli.Get(ctx, key, cm))
+	cached := &staleClient{Client: cli, cached: cm.DeepCopy()}
+
+	// changed by someone else since read
+	other := cm.DeepCopy()
+	other.Labels = map[string]string{"team": "a"}
+	require.NoError(t, cli.Update(ctx, other))
+
+	mutate := func() error {
+		cm.Data = map[string]string{"k": "v"}
+		return nil
+	}
+
+	// the retry reads around the stale cache
+	kcli := NewKcli(cached, cli, scheme, nil, &corev1.ConfigMap{}, nil)
+	require.NoError(t, kcli.UpdateObject(ctx, cm, mutate))
+	require.Equal(t, "a", cm.Labels["team"])
+
+	got := &corev1.ConfigMap{}
+	require.NoError(t, cli.Get(ctx, key, got))
+	require.Equal(t, "v", got.Data["k"])
+	require.Equal(t, "a", got.Labels["team"])
+
+	// reading the cache again only ever sees the old resourceVersion
+	require.NoError(t, cli.Get(ctx, key, cm))
+	cached.cached = cm.DeepCopy()
+	other = cm.DeepCopy()
+	other.Labels = map[string]string{"team": "b"}
+	require.NoError(t, cli.Update(ctx, other))
+
+	kcli = NewKcli(cached, cached, scheme, nil, &corev1.ConfigMap{}, nil)
+	require.Error(t, kcli.UpdateObject(ctx, cm, mutate))
+}
+
+func TestWriteStatus(t *testing.T) {
+	ctx := context.Background()
+	scheme := newScheme(t)
+
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&dbv1.Etcd{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1"},
+		Status: dbv1.EtcdStatus{
+			Status:   dbv1.StatusPartialReady,
+			Upgrade:  &dbv1.UpgradeStatus{Phase: dbv1.UpgradePhaseUpgrading},
+			Adoption: &dbv1.AdoptionStatus{Phase: dbv1.AdoptionPhaseFailed},
+		},
+	}).Build()
+	key := types.NamespacedName{Name: "foo", Namespace: "default"}
+
+	cr := &dbv1.Etcd{}
+	require.NoError(t, cli.Get(ctx, key, cr))
+	kcli := NewKcli(cli, nil, scheme, nil, cr, nil)
+
+	// changed by someone else since read, no precondition on the status patch
+	other := cr.DeepCopy()
+	other.Labels = map[string]string{"team": "a"}
+	require.NoError(t, cli.Update(ctx, other))
+
+	// fields cleared in memory are removed by the patch
+	cr.Status.Status = dbv1.StatusReady
+	cr.Status.Upgrade = nil
+	require.NoError(t, kcli.WriteStatus(ctx, cr))
+
+	got := &dbv1.Etcd{}
+	require.NoError(t, cli.Get(ctx, key, got))
+	require.Equal(t, dbv1.StatusReady, got.Status.Status)
+	require.Nil(t, got.Status.Upgrade)
+	require.NotNil(t, got.Status.Adoption)
+	require.Equal(t, "a", got.Labels["team"])
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	Namespace = "etcd_operator"
+)
+
+var (
+	ReconcileStepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "reconcile_step_duration_seconds",
+		Help:      "Duration of each step of the Etcd reconcile.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"step"})
+
+	ReconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "reconcile_errors_total",
+		Help:      "Reconciles ended by an error, by category: transient, waiting, permanent or conflict.",
+	}, []string{"type"})
+
+	StatusWritesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "status_writes_skipped_total",
+		Help:      "Status writes left out since the status had not changed.",
+	})
+)
+
+func init() {
+	// served on --metrics-bind-address along with the controller-runtime metrics
+	metrics.Registry.MustRegister(ReconcileStepDuration, ReconcileErrors, StatusWritesSkipped)
+}
+
+// Time runs a reconcile step and observes its duration, errors included
+func Time(step string, f func() error) error {
+	start := time.Now()
+	defer func() {
+		ReconcileStepDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+	}()
+
+	return f()
+}
@@ -0,0 +1,182 @@
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+
+	errors2 "github.com/pkg/errors"
+	"github.com/win5do/go-lib/errx"
+)
+
+const (
+	CAValidity   = 10 * 365 * 24 * time.Hour
+	CertValidity = 365 * 24 * time.Hour
+	// RenewBefore certs are reissued once they expire within this window
+	RenewBefore = 30 * 24 * time.Hour
+
+	keySize = 2048
+)
+
+// KeyPair a certificate with its private key, kept in PEM form for Secrets
+type KeyPair struct {
+	Cert    *x509.Certificate
+	Key     *rsa.PrivateKey
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// NewCA self-signed CA used to issue the certs of one cluster
+func NewCA(cn string) (*KeyPair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	return sign(tpl, tpl, key, key)
+}
+
+// Issue signs a leaf cert, hosts may be DNS names or IPs
+func (ca *KeyPair) Issue(cn string, orgs, hosts []string, usages ...x509.ExtKeyUsage) (*KeyPair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   cn,
+			Organization: orgs,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(CertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: usages,
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, h)
+		}
+	}
+
+	return sign(tpl, ca.Cert, key, ca.Key)
+}
+
+// Verify the cert is signed by ca, valid for RenewBefore longer and issued to cn
+func (ca *KeyPair) Verify(certPEM []byte, cn string) error {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	if cert.Subject.CommonName != cn {
+		return errors2.Errorf("cert issued to %s, want %s", cert.Subject.CommonName, cn)
+	}
+
+	if time.Now().Add(RenewBefore).After(cert.NotAfter) {
+		return errors2.Errorf("cert expires at %s", cert.NotAfter)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return errx.WithStackOnce(err)
+	}
+
+	return nil
+}
+
+func ParseKeyPair(certPEM, keyPEM []byte) (*KeyPair, error) {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	b, _ := pem.Decode(keyPEM)
+	if b == nil {
+		return nil, errors2.New("invalid key PEM")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	return &KeyPair{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: certPEM,
+		KeyPEM:  keyPEM,
+	}, nil
+}
+
+func parseCert(certPEM []byte) (*x509.Certificate, error) {
+	b, _ := pem.Decode(certPEM)
+	if b == nil {
+		return nil, errors2.New("invalid cert PEM")
+	}
+
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	return cert, nil
+}
+
+func sign(tpl, parent *x509.Certificate, key, parentKey *rsa.PrivateKey) (*KeyPair, error) {
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errx.WithStackOnce(err)
+	}
+
+	return &KeyPair{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
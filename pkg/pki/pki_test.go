@@ -0,0 +1,30 @@
+package pki
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssue(t *testing.T) {
+	ca, err := NewCA("etcd-ca")
+	require.NoError(t, err)
+	require.True(t, ca.Cert.IsCA)
+
+	cert, err := ca.Issue("etcd-server", nil, []string{"*.foo.default.svc", "127.0.0.1"}, x509.ExtKeyUsageServerAuth)
+	require.NoError(t, err)
+	require.Equal(t, []string{"*.foo.default.svc"}, cert.Cert.DNSNames)
+	require.Len(t, cert.Cert.IPAddresses, 1)
+
+	require.NoError(t, ca.Verify(cert.CertPEM, "etcd-server"))
+	require.Error(t, ca.Verify(cert.CertPEM, "other"))
+
+	other, err := NewCA("other-ca")
+	require.NoError(t, err)
+	require.Error(t, other.Verify(cert.CertPEM, "etcd-server"))
+
+	parsed, err := ParseKeyPair(ca.CertPEM, ca.KeyPEM)
+	require.NoError(t, err)
+	require.NoError(t, parsed.Verify(cert.CertPEM, "etcd-server"))
+}
@@ -0,0 +1,76 @@
+package rerr
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Policy exponential backoff, the attempt n waits Base*Factor^n capped by Cap, plus up to Jitter of it
+type Policy struct {
+	Base   time.Duration
+	Factor float64
+	Cap    time.Duration
+	Jitter float64
+}
+
+var Policies = map[Category]Policy{
+	CategoryWaiting:   {Base: 3 * time.Second, Factor: 1.5, Cap: 30 * time.Second, Jitter: 0.1},
+	CategoryConflict:  {Base: 100 * time.Millisecond, Factor: 2, Cap: 5 * time.Second, Jitter: 0.5},
+	CategoryTransient: {Base: 3 * time.Second, Factor: 2, Cap: 5 * time.Minute, Jitter: 0.2},
+	// CategoryPermanent is not requeued, it is fixed by a spec change which triggers a reconcile anyway
+}
+
+func (p Policy) Duration(attempt int) time.Duration {
+	d := time.Duration(float64(p.Base) * math.Pow(p.Factor, float64(attempt)))
+	if d > p.Cap || d <= 0 {
+		d = p.Cap
+	}
+
+	if p.Jitter > 0 {
+		d = wait.Jitter(d, p.Jitter)
+	}
+
+	return d
+}
+
+type attempts struct {
+	category Category
+	n        int
+}
+
+// Backoff counts the consecutive failures of each cr, shared by all reconciles.
+// The count of a cr is dropped on success, on a permanent error and once the cr is gone.
+type Backoff struct {
+	mu       sync.Mutex
+	attempts map[string]attempts
+}
+
+func NewBackoff() *Backoff {
+	return &Backoff{
+		attempts: map[string]attempts{},
+	}
+}
+
+// Next delay for key, the count restarts when the category changes
+func (s *Backoff) Next(key string, c Category) time.Duration {
+	s.mu.Lock()
+	a := s.attempts[key]
+	if a.category != c {
+		a = attempts{category: c}
+	}
+	n := a.n
+	a.n++
+	s.attempts[key] = a
+	s.mu.Unlock()
+
+	return Policies[c].Duration(n)
+}
+
+func (s *Backoff) Reset(key string) {
+	s.mu.Lock()
+	delete(s.attempts, key)
+	s.mu.Unlock()
+}
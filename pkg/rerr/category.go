@@ -0,0 +1,32 @@
+package rerr
+
+import (
+	errors2 "github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+type Category string
+
+const (
+	// CategoryTransient API or network errors, retried with backoff
+	CategoryTransient Category = "transient"
+	// CategoryWaiting Err_wait_requeue, the cluster is converging
+	CategoryWaiting Category = "waiting"
+	// CategoryPermanent the spec is invalid, surfaced as the Degraded condition
+	CategoryPermanent Category = "permanent"
+	// CategoryConflict stale resourceVersion, retried soon against the refreshed cache
+	CategoryConflict Category = "conflict"
+)
+
+func Classify(err error) Category {
+	switch {
+	case errors2.Is(err, Err_wait_requeue):
+		return CategoryWaiting
+	case errors2.Is(err, Err_invalid_spec), kerrors.IsInvalid(err):
+		return CategoryPermanent
+	case kerrors.IsConflict(err), kerrors.IsAlreadyExists(err):
+		return CategoryConflict
+	default:
+		return CategoryTransient
+	}
+}
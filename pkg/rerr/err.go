@@ -7,4 +7,6 @@ import (
 var (
 	Err_wait_requeue  = errors.New("wait requeue")
 	Err_status_not_ok = errors.New("status not ok")
+	// spec can not be reconciled until the user changes it, wrap with errors2.Wrapf
+	Err_invalid_spec = errors.New("invalid spec")
 )
@@ -1,40 +1,85 @@
 package rerr
 
 import (
-	"time"
-
-	errors2 "github.com/pkg/errors"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/win5do/etcd-operator/pkg/metrics"
 )
 
+const ReasonReconcileError = "ReconcileError"
+
 type Handler struct {
-	log *zap.SugaredLogger
+	log      *zap.SugaredLogger
+	recorder record.EventRecorder
+	obj      runtime.Object
+	backoff  *Backoff
+	key      string
+
+	// OnPermanent surfaces an invalid spec on the cr, e.g. as a condition
+	OnPermanent func(err error)
 }
 
-func NewHandler(log *zap.SugaredLogger) *Handler {
+// NewHandler errors other than requeue are recorded as Warning events on obj
+func NewHandler(log *zap.SugaredLogger, recorder record.EventRecorder, obj runtime.Object, backoff *Backoff) *Handler {
+	var key string
+	if o, err := meta.Accessor(obj); err == nil {
+		key = o.GetNamespace() + "/" + o.GetName()
+	}
+
 	return &Handler{
-		log: log,
+		log:      log,
+		recorder: recorder,
+		obj:      obj,
+		backoff:  backoff,
+		key:      key,
 	}
 }
 
+// HandleErr requeues after the backoff of the error category. The error is not returned
+// to controller-runtime, its rate limiter would take over and ignore RequeueAfter.
+// Permanent errors are not requeued, the next reconcile comes with a spec change.
 func (s *Handler) HandleErr(err error) (ctrl.Result, error) {
 	rlog := s.log
 
 	if err == nil {
+		s.backoff.Reset(s.key)
 		return ctrl.Result{}, nil
 	}
 
-	r := ctrl.Result{
-		Requeue:      true,
-		RequeueAfter: 3 * time.Second,
-	}
+	c := Classify(err)
+	metrics.ReconcileErrors.WithLabelValues(string(c)).Inc()
 
-	if errors2.Is(err, Err_wait_requeue) {
+	switch c {
+	case CategoryWaiting:
 		rlog.Debugf("requeue: %+v", err.Error())
-		return r, nil
-	} else {
+	case CategoryConflict:
+		rlog.Infof("conflict, retry: %v", err)
+	case CategoryPermanent:
+		rlog.Errorf("invalid spec: %+v", err)
+		s.event(err)
+		if s.OnPermanent != nil {
+			s.OnPermanent(err)
+		}
+		s.backoff.Reset(s.key)
+		return ctrl.Result{}, nil
+	default:
 		rlog.Errorf("err: %+v", err)
-		return r, err
+		s.event(err)
+	}
+
+	return ctrl.Result{
+		Requeue:      true,
+		RequeueAfter: s.backoff.Next(s.key, c),
+	}, nil
+}
+
+func (s *Handler) event(err error) {
+	if s.recorder != nil {
+		s.recorder.Event(s.obj, corev1.EventTypeWarning, ReasonReconcileError, err.Error())
 	}
 }
@@ -0,0 +1,70 @@
+package rerr
+
+import (
+	"testing"
+	"time"
+
+	errors2 "github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestClassify(t *testing.T) {
+	gr := schema.GroupResource{Resource: "statefulsets"}
+
+	require.Equal(t, CategoryWaiting, Classify(errors2.WithStack(Err_wait_requeue)))
+	require.Equal(t, CategoryPermanent, Classify(errors2.Wrapf(Err_invalid_spec, "storage class %s", "foo")))
+	require.Equal(t, CategoryPermanent, Classify(errors2.WithStack(kerrors.NewInvalid(schema.GroupKind{Kind: "StatefulSet"}, "foo", nil))))
+	require.Equal(t, CategoryConflict, Classify(errors2.WithStack(kerrors.NewConflict(gr, "foo", errors2.New("stale")))))
+	require.Equal(t, CategoryTransient, Classify(kerrors.NewTimeoutError("slow", 1)))
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{Base: time.Second, Factor: 2, Cap: 5 * time.Second}
+	require.Equal(t, time.Second, p.Duration(0))
+	require.Equal(t, 4*time.Second, p.Duration(2))
+	require.Equal(t, 5*time.Second, p.Duration(3))
+	require.Equal(t, 5*time.Second, p.Duration(100))
+
+	b := NewBackoff()
+	w := Policies[CategoryTransient]
+	require.Less(t, int64(b.Next("a", CategoryTransient)), int64(float64(w.Base)*(1+w.Jitter)))
+	require.GreaterOrEqual(t, int64(b.Next("a", CategoryTransient)), int64(2*w.Base))
+
+	// category changed, count restarts
+	require.Less(t, int64(b.Next("a", CategoryConflict)), int64(time.Second))
+
+	b.Reset("a")
+	require.Less(t, int64(b.Next("a", CategoryTransient)), int64(2*w.Base))
+}
+
+func TestHandleErr(t *testing.T) {
+	obj := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	h := NewHandler(zap.NewNop().Sugar(), nil, obj, NewBackoff())
+
+	var surfaced error
+	h.OnPermanent = func(err error) {
+		surfaced = err
+	}
+
+	// a spec change brings the next reconcile
+	r, err := h.HandleErr(errors2.Wrap(Err_invalid_spec, "bad"))
+	require.NoError(t, err)
+	require.Equal(t, ctrl.Result{}, r)
+	require.Error(t, surfaced)
+	require.Empty(t, h.backoff.attempts)
+
+	r, err = h.HandleErr(errors2.WithStack(Err_wait_requeue))
+	require.NoError(t, err)
+	require.True(t, r.Requeue)
+	require.Len(t, h.backoff.attempts, 1)
+
+	r, err = h.HandleErr(nil)
+	require.NoError(t, err)
+	require.False(t, r.Requeue)
+	require.Empty(t, h.backoff.attempts)
+}
@@ -2,8 +2,17 @@ package test
 
 import (
 	"os"
+	"testing"
 )
 
 func ShouldRun() bool {
 	return os.Getenv("integration") == "true"
 }
+
+// Integration skips t unless integration tests are enabled, they need a cluster
+func Integration(t *testing.T) {
+	t.Helper()
+	if !ShouldRun() {
+		t.Skip("integration test, set integration=true")
+	}
+}